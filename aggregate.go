@@ -0,0 +1,216 @@
+package opendivdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Aggregate functions
+const (
+	aggregate_sum = "sum"
+	aggregate_avg = "avg"
+	aggregate_min = "min"
+	aggregate_max = "max"
+)
+
+type (
+	// Aggregation computes totals over the documents of a collection matching its filter,
+	// optionally grouped by the values of one or more fields
+	Aggregation struct {
+		collection *Collection
+		group_by   []string
+		count      bool
+		aggregates []aggregate
+	}
+
+	aggregate struct {
+		function string // sum, avg, min or max
+		field    string
+	}
+
+	// Result of an aggregation for one group, the maps are keyed by field name and only hold
+	// the fields the function was requested for. Fields missing from a document are skipped,
+	// Avg, Min and Max are not set for a field no document of the group has
+	AggregateResult struct {
+		Group map[string]any // Value of each GroupBy field, nil if the documents don't have the field
+		Count int            // Number of documents in the group, only set if Count was requested
+		Sum   map[string]float64
+		Avg   map[string]float64
+		Min   map[string]float64
+		Max   map[string]float64
+	}
+
+	// Running totals of a field within a group
+	aggregate_field struct {
+		sum      float64
+		min      float64
+		max      float64
+		count    int
+		has_data bool
+	}
+
+	aggregate_group struct {
+		values []any
+		count  int
+		fields map[string]*aggregate_field
+	}
+)
+
+// Start an aggregation over the collection, the collection's filter set with Where is applied
+func (c *Collection) Aggregate() *Aggregation {
+	return &Aggregation{collection: c}
+}
+
+// Group the results by the values of fields, without GroupBy a single result is returned
+func (a *Aggregation) GroupBy(fields ...string) *Aggregation {
+	a.group_by = append(a.group_by, fields...)
+	return a
+}
+
+// Count the documents of each group
+func (a *Aggregation) Count() *Aggregation {
+	a.count = true
+	return a
+}
+
+// Sum a number field
+func (a *Aggregation) Sum(field string) *Aggregation {
+	a.aggregates = append(a.aggregates, aggregate{function: aggregate_sum, field: field})
+	return a
+}
+
+// Average a number field
+func (a *Aggregation) Avg(field string) *Aggregation {
+	a.aggregates = append(a.aggregates, aggregate{function: aggregate_avg, field: field})
+	return a
+}
+
+// Smallest value of a number field
+func (a *Aggregation) Min(field string) *Aggregation {
+	a.aggregates = append(a.aggregates, aggregate{function: aggregate_min, field: field})
+	return a
+}
+
+// Largest value of a number field
+func (a *Aggregation) Max(field string) *Aggregation {
+	a.aggregates = append(a.aggregates, aggregate{function: aggregate_max, field: field})
+	return a
+}
+
+// Results runs the aggregation and returns one result per group, ordered by the JSON encoding
+// of the group values. A field that is not a number in a document returns an error
+func (a *Aggregation) Results() ([]AggregateResult, error) {
+	col, err := a.collection.documents(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*aggregate_group)
+	// Without GroupBy there is a single result even if no document matches
+	if len(a.group_by) == 0 {
+		groups["[]"] = a.newGroup([]any{})
+	}
+	for _, doc := range col {
+		var data map[string]any
+		if err := json.Unmarshal(doc.Data, &data); err != nil {
+			return nil, fmt.Errorf("unable to un-marshall document '%s' - %w", doc.ID, err)
+		}
+
+		values := make([]any, len(a.group_by))
+		for i, field := range a.group_by {
+			values[i] = data[field]
+		}
+		key_b, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		group, ok := groups[string(key_b)]
+		if !ok {
+			group = a.newGroup(values)
+			groups[string(key_b)] = group
+		}
+		group.count++
+
+		for field, totals := range group.fields {
+			value, ok := data[field]
+			if !ok || value == nil {
+				continue
+			}
+			number, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("field '%s' of document '%s' is not a number", field, doc.ID)
+			}
+			totals.add(number)
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	results := make([]AggregateResult, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		result := AggregateResult{Group: make(map[string]any, len(a.group_by))}
+		for i, field := range a.group_by {
+			result.Group[field] = group.values[i]
+		}
+		if a.count {
+			result.Count = group.count
+		}
+		for _, agg := range a.aggregates {
+			totals := group.fields[agg.field]
+			switch agg.function {
+			case aggregate_sum:
+				setResult(&result.Sum, agg.field, totals.sum)
+			case aggregate_avg:
+				if totals.has_data {
+					setResult(&result.Avg, agg.field, totals.sum/float64(totals.count))
+				}
+			case aggregate_min:
+				if totals.has_data {
+					setResult(&result.Min, agg.field, totals.min)
+				}
+			case aggregate_max:
+				if totals.has_data {
+					setResult(&result.Max, agg.field, totals.max)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Group with running totals for every aggregated field
+func (a *Aggregation) newGroup(values []any) *aggregate_group {
+	group := &aggregate_group{values: values, fields: make(map[string]*aggregate_field)}
+	for _, agg := range a.aggregates {
+		group.fields[agg.field] = &aggregate_field{}
+	}
+	return group
+}
+
+func (f *aggregate_field) add(value float64) {
+	if !f.has_data || value < f.min {
+		f.min = value
+	}
+	if !f.has_data || value > f.max {
+		f.max = value
+	}
+	f.sum += value
+	f.count++
+	f.has_data = true
+}
+
+// Set a value in a result map, creating the map on first use
+func setResult(m *map[string]float64, field string, value float64) {
+	if *m == nil {
+		*m = make(map[string]float64)
+	}
+	(*m)[field] = value
+}
@@ -1,6 +1,7 @@
 package opendivdb
 
 import (
+	"context"
 	"os"
 	"strconv"
 	"testing"
@@ -31,6 +32,7 @@ func Benchmark_NonEncrypted_Serial(b *testing.B) {
 	if err != nil {
 		b.Fatal("Unable to create DB! " + err.Error())
 	}
+	defer DB.Close(context.Background())
 
 	// Test sequential write
 	for id := range number_of_documents {
@@ -63,6 +65,7 @@ func Benchmark_NonEncrypted_Parallel(b *testing.B) {
 	if err != nil {
 		b.Fatal("Unable to create DB! " + err.Error())
 	}
+	defer DB.Close(context.Background())
 
 	// Test parallel write
 	eg := errgroup.Group{}
@@ -99,6 +102,7 @@ func Benchmark_Encrypted_Serial(b *testing.B) {
 	if err != nil {
 		b.Fatal("Unable to create DB! " + err.Error())
 	}
+	defer DB.Close(context.Background())
 
 	// Test sequential write
 	for id := range number_of_documents {
@@ -131,6 +135,7 @@ func Benchmark_Encrypted_Parallel(b *testing.B) {
 	if err != nil {
 		b.Fatal("Unable to create DB! " + err.Error())
 	}
+	defer DB.Close(context.Background())
 
 	// Test parallel write
 	eg := errgroup.Group{}
@@ -1,77 +1,502 @@
 package opendivdb
 
 import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
 	"sync"
 	"time"
 )
 
+// Cache eviction policies
+const (
+	Cache_lru = "LRU" // Evict the least recently used document
+	Cache_lfu = "LFU" // Evict the least frequently used document, ties are broken by least recently used
+)
+
 type (
+	// Documents are kept in lists bucketed by use count. With LRU every document stays in
+	// the first bucket so the bucket's tail is the least recently used document, with LFU
+	// the tail of the lowest bucket is the least frequently used one. Documents of pinned
+	// collections are not in any bucket or in the expiry heap so they are never evicted
 	cache struct {
-		documents map[string]cached_doc //Cached documents
-		timeout   time.Duration         // Cache timeout in seconds
-		limit     float64               // Maximum number of cached documents
-		mutex     sync.Mutex
+		documents          map[string]*cached_doc          // Cached documents keyed by collection/document
+		buckets            map[int]*list.List              // Documents ordered by most recent use, per use count
+		min_uses           int                             // Lowest use count with documents in it
+		expiry             expiry_heap                     // Documents ordered by expiry time, soonest first
+		timeout            time.Duration                   // Cache timeout in seconds
+		timeouts           map[string]time.Duration        // Cache timeout overrides by collection name
+		limit              int                             // Maximum number of cached documents
+		max_bytes          int64                           // Maximum size of cached documents in bytes, 0 for no limit
+		bytes              int64                           // Current size of cached documents in bytes
+		policy             string                          // Eviction policy, LRU or LFU
+		pinned_collections map[string]bool                 // Collections whose documents are never evicted
+		pinned_count       int                             // Number of cached documents that are pinned
+		pinned_bytes       int64                           // Size of cached documents that are pinned, included in bytes
+		hits               uint64                          // Number of reads answered from the cache
+		misses             uint64                          // Number of reads not found in the cache
+		evictions_timeout  uint64                          // Number of documents removed because they expired
+		evictions_limit    uint64                          // Number of documents removed to stay within the limits
+		collections        map[string]*collection_counters // Per collection statistics
+		wake               chan struct{}                   // Signals the purge loop that the soonest expiry changed
+		done               chan struct{}                   // Closed to stop the purge loop
+		stop_once          sync.Once
+		mutex              sync.Mutex
 	}
 
+	expiry_heap []*cached_doc
+
 	cached_doc struct {
-		cached_at time.Time
-		document  Document
+		key        string
+		collection string
+		cached_at  time.Time
+		expires_at time.Time
+		index      int // Position in the expiry heap, -1 when not in it
+		document   Document
+		size       int64
+		uses       int
+		pinned     bool
+		element    *list.Element
+	}
+
+	collection_counters struct {
+		hits      uint64
+		misses    uint64
+		documents int
+		bytes     int64
+	}
+
+	CacheStats struct {
+		Hits              uint64                          // Number of reads answered from the cache
+		Misses            uint64                          // Number of reads not found in the cache
+		Evictions_timeout uint64                          // Number of documents removed because they expired
+		Evictions_limit   uint64                          // Number of documents removed to stay within cache_limit or cache_max_bytes
+		Documents         int                             // Number of documents currently cached
+		Bytes             int64                           // Size of documents currently cached in bytes
+		Collections       map[string]CollectionCacheStats // Statistics by collection name
+		Query_hits        uint64                          // Number of queries answered from cached results
+		Query_misses      uint64                          // Number of queries that had to read the collection
+		Queries           int                             // Number of query results currently cached
+	}
+
+	CollectionCacheStats struct {
+		Hits      uint64
+		Misses    uint64
+		Documents int
+		Bytes     int64
+		Pinned    bool
 	}
 )
 
-// Must be run as a go routine. Runs an infinite loop to check the cache every 5 seconds to deletes expired cache
+func newCache(timeout time.Duration, timeouts map[string]time.Duration, limit int, max_bytes int64, policy string) cache {
+	if timeouts == nil {
+		timeouts = make(map[string]time.Duration)
+	}
+	return cache{
+		documents:          make(map[string]*cached_doc),
+		buckets:            make(map[int]*list.List),
+		min_uses:           1,
+		timeout:            timeout,
+		timeouts:           timeouts,
+		limit:              limit,
+		max_bytes:          max_bytes,
+		policy:             policy,
+		pinned_collections: make(map[string]bool),
+		collections:        make(map[string]*collection_counters),
+		wake:               make(chan struct{}, 1),
+		done:               make(chan struct{}),
+	}
+}
+
+func validateCachePolicy(policy string) error {
+	switch policy {
+	case Cache_lru, Cache_lfu:
+		return nil
+	}
+	return fmt.Errorf("cache policy '%s' is not supported. Accepted policies %s, %s", policy, Cache_lru, Cache_lfu)
+}
+
+// Approximate memory used by a cached document
+func docSize(doc Document) int64 {
+	return int64(len(doc.Data) + len(doc.ID) + len(doc.Collection) + len(doc.Hash))
+}
+
+// Must be run as a go routine. Sleeps until the soonest cached document expires, removes
+// every expired document and repeats until the cache is stopped
 func (c *cache) runCachePurge() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		case <-timer.C:
+		}
+
 		c.mutex.Lock()
-		for id, value := range c.documents {
-			if value.cached_at.Add(c.timeout).Before(time.Now()) {
-				delete(c.documents, id)
-			}
+		now := time.Now()
+		for len(c.expiry) > 0 && !c.expiry[0].expires_at.After(now) {
+			c.remove(c.expiry[0])
+			c.evictions_timeout++
+		}
+		if len(c.expiry) > 0 {
+			timer.Reset(c.expiry[0].expires_at.Sub(now))
+		} else {
+			timer.Stop()
 		}
 		c.mutex.Unlock()
-		time.Sleep(time.Second * 1)
 	}
 }
 
-func (c *cache) add(coll_ref Collection, doc Document) {
+// Stop the purge loop
+func (c *cache) stop() {
+	c.stop_once.Do(func() { close(c.done) })
+}
+
+// Cache timeout of a collection
+func (c *cache) timeoutFor(collection_name string) time.Duration {
+	if timeout, ok := c.timeouts[collection_name]; ok {
+		return timeout
+	}
+	return c.timeout
+}
+
+// Add a document to the expiry heap, must be called with the cache mutex held
+func (c *cache) schedule(entry *cached_doc) {
+	entry.expires_at = entry.cached_at.Add(c.timeoutFor(entry.collection))
+	heap.Push(&c.expiry, entry)
+	// Wake the purge loop if this document expires before every other one
+	if entry.index == 0 {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *cache) add(collection_name string, doc Document) {
 	// Obtain Mutex
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	// Check how many documents are in cache
-	num_of_cached_docs := len(c.documents)
-
-	// If there are more or equal to the cache limit
-	if num_of_cached_docs >= int(c.limit) {
-		oldest_doc := cached_doc{}
-
-		// Loop through all cached documents and find the one that was cached the longest
-		for _, doc := range c.documents {
-			if oldest_doc.cached_at.IsZero() {
-				oldest_doc = doc
-			} else {
-				if doc.cached_at.Before(oldest_doc.cached_at) {
-					oldest_doc = doc
-				}
-			}
+
+	doc.From_cache = true
+	key := collection_name + "/" + doc.ID
+	size := docSize(doc)
+	pinned := c.pinned_collections[collection_name]
+
+	// Replace the previous version of the document
+	if entry, ok := c.documents[key]; ok {
+		c.remove(entry)
+	}
+
+	if !pinned {
+		// Document alone is larger than the cache, don't cache it
+		if c.max_bytes > 0 && size > c.max_bytes {
+			return
+		}
+		// Evict documents until the new one fits
+		for c.overLimit(size) {
+			c.evict()
 		}
-		c.delete(coll_ref.collection_name, oldest_doc.document.ID)
 	}
 
-	doc.From_cache = true
-	cached_doc := cached_doc{cached_at: time.Now(), document: doc}
-	c.documents[coll_ref.collection_name+"/"+doc.ID] = cached_doc
+	entry := &cached_doc{key: key, collection: collection_name, cached_at: time.Now(), index: -1, document: doc, size: size, uses: 1, pinned: pinned}
+	c.documents[key] = entry
+	c.bytes += size
+	counters := c.counters(collection_name)
+	counters.documents++
+	counters.bytes += size
+	if pinned {
+		c.pinned_count++
+		c.pinned_bytes += size
+	} else {
+		c.link(entry)
+		c.schedule(entry)
+	}
 }
 
 func (c *cache) getDoc(collection_name string, document_id string) (Document, bool) {
-	if val, ok := c.documents[collection_name+"/"+document_id]; ok {
-		val.cached_at = time.Now()
-		c.documents[collection_name+"/"+document_id] = val
-		return val.document, true
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.documents[collection_name+"/"+document_id]
+	if !ok {
+		c.misses++
+		c.counters(collection_name).misses++
+		return Document{}, false
 	}
-	return Document{}, false
+	c.hits++
+	c.counters(collection_name).hits++
+	entry.cached_at = time.Now()
+	if !entry.pinned {
+		c.touch(entry)
+		// Reading a document extends its expiry, the purge loop wakes at the old expiry and reschedules
+		entry.expires_at = entry.cached_at.Add(c.timeoutFor(collection_name))
+		heap.Fix(&c.expiry, entry.index)
+	}
+	return entry.document, true
 }
 
 // Delete Document from Cache
 func (c *cache) delete(collection_name string, document_id string) {
-	delete(c.documents, collection_name+"/"+document_id)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry, ok := c.documents[collection_name+"/"+document_id]; ok {
+		c.remove(entry)
+	}
+}
+
+// Remove every cached document of a collection
+func (c *cache) deleteCollection(collection_name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, entry := range c.documents {
+		if entry.collection == collection_name {
+			c.remove(entry)
+		}
+	}
+}
+
+// Keep documents of a collection in the cache regardless of limits and timeout
+func (c *cache) pin(collection_name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pinned_collections[collection_name] = true
+	for _, entry := range c.documents {
+		if entry.collection == collection_name && !entry.pinned {
+			c.unlink(entry)
+			heap.Remove(&c.expiry, entry.index)
+			entry.pinned = true
+			c.pinned_count++
+			c.pinned_bytes += entry.size
+		}
+	}
+}
+
+// Return documents of a pinned collection to normal eviction
+func (c *cache) unpin(collection_name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pinned_collections, collection_name)
+	for _, entry := range c.documents {
+		if entry.collection == collection_name && entry.pinned {
+			entry.pinned = false
+			c.pinned_count--
+			c.pinned_bytes -= entry.size
+			entry.cached_at = time.Now()
+			c.link(entry)
+			c.schedule(entry)
+		}
+	}
+	// Unpinned documents may have pushed the cache over its limits
+	for c.overLimit(0) {
+		c.evict()
+	}
+}
+
+func (c *cache) stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := CacheStats{
+		Hits:              c.hits,
+		Misses:            c.misses,
+		Evictions_timeout: c.evictions_timeout,
+		Evictions_limit:   c.evictions_limit,
+		Documents:         len(c.documents),
+		Bytes:             c.bytes,
+		Collections:       make(map[string]CollectionCacheStats),
+	}
+	for name, counters := range c.collections {
+		stats.Collections[name] = CollectionCacheStats{
+			Hits:      counters.hits,
+			Misses:    counters.misses,
+			Documents: counters.documents,
+			Bytes:     counters.bytes,
+			Pinned:    c.pinned_collections[name],
+		}
+	}
+	return stats
+}
+
+// Return the statistics of a collection, creating them if needed
+func (c *cache) counters(collection_name string) *collection_counters {
+	counters, ok := c.collections[collection_name]
+	if !ok {
+		counters = &collection_counters{}
+		c.collections[collection_name] = counters
+	}
+	return counters
+}
+
+// Check if adding a document of size bytes would exceed the limits, must be called with the cache mutex held
+func (c *cache) overLimit(size int64) bool {
+	evictable := len(c.documents) - c.pinned_count
+	if evictable == 0 {
+		return false
+	}
+	if size == 0 {
+		return evictable > c.limit || (c.max_bytes > 0 && c.bytes-c.pinned_bytes > c.max_bytes)
+	}
+	return evictable >= c.limit || (c.max_bytes > 0 && c.bytes-c.pinned_bytes+size > c.max_bytes)
+}
+
+// Return the list of documents for a use count, creating it if needed
+func (c *cache) bucket(uses int) *list.List {
+	b, ok := c.buckets[uses]
+	if !ok {
+		b = list.New()
+		c.buckets[uses] = b
+	}
+	return b
+}
+
+// Add a document to its bucket, must be called with the cache mutex held
+func (c *cache) link(entry *cached_doc) {
+	entry.element = c.bucket(entry.uses).PushFront(entry)
+	if len(c.buckets) == 1 || entry.uses < c.min_uses {
+		c.min_uses = entry.uses
+	}
+}
+
+// Record a use of a cached document, must be called with the cache mutex held
+func (c *cache) touch(entry *cached_doc) {
+	if c.policy != Cache_lfu {
+		c.buckets[entry.uses].MoveToFront(entry.element)
+		return
+	}
+
+	c.unlink(entry)
+	entry.uses++
+	c.link(entry)
+}
+
+// Remove a document from its bucket, must be called with the cache mutex held
+func (c *cache) unlink(entry *cached_doc) {
+	b := c.buckets[entry.uses]
+	b.Remove(entry.element)
+	entry.element = nil
+	if b.Len() == 0 {
+		delete(c.buckets, entry.uses)
+		if c.min_uses == entry.uses {
+			c.min_uses++
+		}
+	}
+}
+
+// Remove a document from the cache, must be called with the cache mutex held
+func (c *cache) remove(entry *cached_doc) {
+	if entry.pinned {
+		c.pinned_count--
+		c.pinned_bytes -= entry.size
+	} else {
+		c.unlink(entry)
+		heap.Remove(&c.expiry, entry.index)
+	}
+	delete(c.documents, entry.key)
+	c.bytes -= entry.size
+	counters := c.counters(entry.collection)
+	counters.documents--
+	counters.bytes -= entry.size
+}
+
+// Remove the document chosen by the eviction policy, must be called with the cache mutex held
+func (c *cache) evict() {
+	b, ok := c.buckets[c.min_uses]
+	if !ok {
+		// Lowest bucket was emptied by a removal, find the new lowest one
+		c.min_uses = 0
+		for uses := range c.buckets {
+			if c.min_uses == 0 || uses < c.min_uses {
+				c.min_uses = uses
+			}
+		}
+		if b, ok = c.buckets[c.min_uses]; !ok {
+			return
+		}
+	}
+	c.remove(b.Back().Value.(*cached_doc))
+	c.evictions_limit++
+}
+
+func (h expiry_heap) Len() int           { return len(h) }
+func (h expiry_heap) Less(i, j int) bool { return h[i].expires_at.Before(h[j].expires_at) }
+func (h expiry_heap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiry_heap) Push(x any) {
+	entry := x.(*cached_doc)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiry_heap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// CacheStats returns hit, miss and eviction counters and the current size of the cache
+func (d *Driver) CacheStats() CacheStats {
+	stats := d.cache.stats()
+	d.queries.mutex.Lock()
+	defer d.queries.mutex.Unlock()
+	stats.Query_hits = d.queries.hits
+	stats.Query_misses = d.queries.misses
+	stats.Queries = len(d.queries.queries)
+	return stats
+}
+
+// PinCollection keeps the collection's cached documents in memory, they are not evicted by
+// the cache limits or timeout until the collection is unpinned
+func (d *Driver) PinCollection(collection_name string) error {
+	if err := ValidateCollectionPath(collection_name); err != nil {
+		return fmt.Errorf("collection name validation error - %w", err)
+	}
+	d.cache.pin(collection_name)
+	return nil
+}
+
+// UnpinCollection returns the collection's cached documents to normal eviction
+func (d *Driver) UnpinCollection(collection_name string) error {
+	if err := ValidateCollectionPath(collection_name); err != nil {
+		return fmt.Errorf("collection name validation error - %w", err)
+	}
+	d.cache.unpin(collection_name)
+	return nil
+}
+
+// WarmCache reads every document of the collection into the cache
+func (d *Driver) WarmCache(collection_name string) error {
+	if err := ValidateCollectionPath(collection_name); err != nil {
+		return fmt.Errorf("collection name validation error - %w", err)
+	}
+	if err := d.begin(); err != nil {
+		return err
+	}
+	defer d.end()
+	_, err := d.Collection(collection_name).allDocuments(context.Background())
+	return err
+}
+
+// InvalidateCache removes every cached document and query result of the collection
+func (d *Driver) InvalidateCache(collection_name string) error {
+	if err := ValidateCollectionPath(collection_name); err != nil {
+		return fmt.Errorf("collection name validation error - %w", err)
+	}
+	d.cache.deleteCollection(collection_name)
+	d.queries.invalidateCollection(collection_name)
+	return nil
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	opendivdb "github.com/ZsoltFejes/opendiv-db"
+)
+
+// Salt for encryption, built into the binary with -ldflags "-X main.Salt=<this_is_your_salt>"
+var Salt string
+
+// Query a collection from the command line and print the matching documents as JSON
+//
+//	opendivdb -collection tickets -query 'status == "open" AND priority >= 3'
+func main() {
+	config_path := flag.String("config", "db_config.yml", "Path to the configuration file")
+	collection := flag.String("collection", "", "Collection to query, subcollections by their path (collection/document/subcollection)")
+	query := flag.String("query", "", "Query the documents are filtered with, every document is returned without a query")
+	flag.Parse()
+
+	if *collection == "" {
+		fmt.Fprintln(os.Stderr, "-collection was not provided")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Check the query before opening the database so parse errors point at the query
+	if *query != "" {
+		if _, err := opendivdb.ParseQuery(*query); err != nil {
+			printQueryError(*query, err)
+			os.Exit(2)
+		}
+	}
+
+	config, err := opendivdb.LoadConfig(*config_path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR] "+err.Error())
+		os.Exit(1)
+	}
+	config.Salt = Salt
+	// Opened read-only so the database can be queried while another process has it open
+	config.Read_only = true
+	DB, err := opendivdb.NewDB(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR] unable to open database "+err.Error())
+		os.Exit(1)
+	}
+
+	col := DB.Collection(*collection)
+	if *query != "" {
+		col = col.WhereQuery(*query)
+	}
+	docs, err := col.Documents()
+	DB.Close(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR] "+err.Error())
+		os.Exit(1)
+	}
+
+	if docs == nil {
+		docs = []opendivdb.Document{}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(docs); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR] "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// Print a parse error with a marker under the position of the error in the query
+func printQueryError(query string, err error) {
+	query_err := &opendivdb.QueryError{}
+	if !errors.As(err, &query_err) {
+		fmt.Fprintln(os.Stderr, "[ERROR] "+err.Error())
+		return
+	}
+	fmt.Fprintln(os.Stderr, query)
+	fmt.Fprintln(os.Stderr, strings.Repeat(" ", utf8.RuneCountInString(query[:query_err.Position]))+"^ "+query_err.Error())
+}
@@ -0,0 +1,229 @@
+package opendivdb
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Statistics of a collection, subcollections are not included
+type CollectionStats struct {
+	Documents  int       // Number of documents
+	Bytes      int64     // Size of the stored documents, after encryption if enabled
+	Updated_at time.Time // Latest update of a document in the collection, zero if it has no documents
+}
+
+// Collections returns the names of the collections in the database in ascending order,
+// subcollections are included with their path (collection/document/subcollection)
+func (d *Driver) Collections() ([]string, error) {
+	if err := d.begin(); err != nil {
+		return nil, err
+	}
+	defer d.end()
+
+	collections, err := d.storage.Collections()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list collections - %w", storageError(err))
+	}
+	sort.Strings(collections)
+	return collections, nil
+}
+
+// Drop deletes the collection with all of its documents and subcollections. Subscriptions to
+// the dropped collections are closed with ErrDropped and the drop is replicated to other nodes
+func (c *Collection) Drop() error {
+	if err := c.driver.beginWrite(); err != nil {
+		return err
+	}
+	defer c.driver.end()
+
+	err := ValidateCollectionPath(c.collection_name)
+	if err != nil {
+		return fmt.Errorf("collection name validation error - %w", err)
+	}
+
+	if err := c.drop(); err != nil {
+		return err
+	}
+	c.driver.goTracked(func() { c.driver.sendDropToAllNodes(c.collection_name) })
+	return nil
+}
+
+// Internal function to drop a collection and its subcollections
+func (c *Collection) drop() error {
+	collections, err := c.driver.subcollections(c.collection_name)
+	if err != nil {
+		return err
+	}
+	for _, collection_name := range append(collections, c.collection_name) {
+		ids, err := c.driver.storage.List(collection_name)
+		if errors.Is(err, fs.ErrNotExist) {
+			ids = nil
+		} else if err != nil {
+			return fmt.Errorf("unable to list documents of '%s' - %w", collection_name, storageError(err))
+		}
+
+		if err := c.driver.storage.Drop(collection_name); err != nil {
+			return fmt.Errorf("unable to drop '%s' - %w", collection_name, storageError(err))
+		}
+		for _, id := range ids {
+			c.driver.cache.delete(collection_name, id)
+			c.driver.removeDocState(collection_name, id)
+		}
+		if index, ok := c.driver.search[collection_name]; ok {
+			index.clear()
+		}
+		c.driver.queries.invalidateCollection(collection_name)
+		c.driver.closeSubscriptions(collection_name, ErrDropped)
+	}
+	return nil
+}
+
+// Rename moves every document of the collection and its subcollections to a collection
+// named new_name, which must not have any documents. Subscriptions to the old collections
+// are closed with ErrDropped
+func (c *Collection) Rename(new_name string) error {
+	if err := c.driver.beginWrite(); err != nil {
+		return err
+	}
+	defer c.driver.end()
+
+	err := ValidateCollectionPath(c.collection_name)
+	if err != nil {
+		return fmt.Errorf("collection name validation error - %w", err)
+	}
+	err = ValidateCollectionPath(new_name)
+	if err != nil {
+		return fmt.Errorf("new collection name validation error - %w", err)
+	}
+	if new_name == c.collection_name || strings.HasPrefix(new_name, c.collection_name+"/") {
+		return fmt.Errorf("collection '%s' can't be renamed to '%s'", c.collection_name, new_name)
+	}
+	ids, err := c.driver.storage.List(new_name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if len(ids) > 0 {
+		return fmt.Errorf("%w - collection '%s' already exists", ErrConflict, new_name)
+	}
+
+	collections, err := c.driver.subcollections(c.collection_name)
+	if err != nil {
+		return err
+	}
+	// Move the deepest subcollections first, deleting a document removes what is left of its subcollections
+	sort.Slice(collections, func(i, j int) bool {
+		return strings.Count(collections[i], "/") > strings.Count(collections[j], "/")
+	})
+	var moved []Document
+	for _, collection_name := range append(collections, c.collection_name) {
+		from := c.driver.Collection(collection_name)
+		to := c.driver.Collection(new_name + strings.TrimPrefix(collection_name, c.collection_name))
+
+		ids, err := c.driver.storage.List(collection_name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("unable to list documents of '%s' - %w", collection_name, storageError(err))
+		}
+		for _, id := range ids {
+			doc, err := from.read(id)
+			if err != nil {
+				return fmt.Errorf("unable to read document '%s' - %w", id, err)
+			}
+			doc.Collection = to.collection_name
+			if err := to.write(id, doc); err != nil {
+				return err
+			}
+			if err := from.delete(id); err != nil {
+				return err
+			}
+			moved = append(moved, doc)
+		}
+	}
+	// Remove what is left of the old collections
+	if err := c.drop(); err != nil {
+		return err
+	}
+
+	c.driver.goTracked(func() {
+		for _, doc := range moved {
+			c.driver.sendDocToAllNodes(doc)
+		}
+		c.driver.sendDropToAllNodes(c.collection_name)
+	})
+	return nil
+}
+
+// Stats returns the number of documents of the collection, their size and when the collection
+// was last updated
+func (c *Collection) Stats() (CollectionStats, error) {
+	if err := c.driver.begin(); err != nil {
+		return CollectionStats{}, err
+	}
+	defer c.driver.end()
+
+	err := ValidateCollectionPath(c.collection_name)
+	if err != nil {
+		return CollectionStats{}, fmt.Errorf("collection name validation error - %w", err)
+	}
+
+	stats := CollectionStats{}
+	ids, err := c.driver.storage.List(c.collection_name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return stats, nil
+	} else if err != nil {
+		return stats, storageError(err)
+	}
+	for _, id := range ids {
+		// Documents are not read, the size is the one of the stored bytes
+		size, err := c.driver.documentSize(c.collection_name, id)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return stats, fmt.Errorf("unable to get the size of document '%s' - %w", id, storageError(err))
+		}
+		stats.Documents++
+		stats.Bytes += size
+
+		state, ok := c.driver.getDocState(c.collection_name, id)
+		if ok && state.Timestamp.After(stats.Updated_at) {
+			stats.Updated_at = state.Timestamp
+		}
+	}
+	return stats, nil
+}
+
+// Size of a stored document, read from storage if the storage can't tell its size
+func (d *Driver) documentSize(collection_name string, id string) (int64, error) {
+	if storage, ok := d.storage.(size_storage); ok {
+		return storage.Size(collection_name, id)
+	}
+	b, err := d.storage.Read(collection_name, id)
+	return int64(len(b)), err
+}
+
+// Paths of the subcollections under a collection or document path at any depth
+func (d *Driver) subcollections(path string) ([]string, error) {
+	if storage, ok := d.storage.(subcollection_storage); ok {
+		subcollections, err := storage.Subcollections(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list subcollections - %w", storageError(err))
+		}
+		return subcollections, nil
+	}
+
+	collections, err := d.storage.Collections()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list subcollections - %w", storageError(err))
+	}
+	var subcollections []string
+	for _, collection_name := range collections {
+		if strings.HasPrefix(collection_name, path+"/") {
+			subcollections = append(subcollections, collection_name)
+		}
+	}
+	return subcollections, nil
+}
@@ -1,15 +1,20 @@
 package opendivdb
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -23,6 +28,7 @@ type (
 		mutex             sync.Mutex
 		mutexes           map[string]*sync.Mutex
 		cache             cache
+		queries           query_cache
 		dir               string // the directory where scribble will create the database
 		doc_state         map[string]doc_state
 		subs              map[string]*Subscription
@@ -30,6 +36,21 @@ type (
 		replication_pass  string
 		replication_state string
 		replication_port  int
+		sub_buffer        int
+		sub_policy        string
+		server            *http.Server             // Replication listener
+		life_mutex        sync.RWMutex             // Held for writing only while the driver is being closed
+		closed            bool                     // Set once Close is called, every public call then returns ErrClosed
+		inflight          sync.WaitGroup           // Operations and replication pushes that Close waits for
+		read_only         bool                     // Opened without the directory lock, writes return ErrReadOnly
+		lock_file         *os.File                 // Holds the exclusive lock on the database directory
+		durability        string                   // NONE, FILE or FULL
+		storage           Storage                  // Where documents are kept
+		log_segment_size  int64                    // Size at which the LOG storage starts a new segment
+		log_compaction    time.Duration            // Interval between checks for LOG storage segments to compact
+		search            map[string]*search_index // Full-text search index by collection name
+		scan_workers      int                      // Number of documents a query reads concurrently
+		slow_query        atomic.Int64             // Queries taking longer are logged, nanoseconds, 0 disables the log
 	}
 
 	Document struct {
@@ -42,36 +63,103 @@ type (
 	}
 
 	Config struct {
-		Encryption_key    string            `yaml:"encryption_key,omitempty"`    // Database encryption key must be 32 characters long for AES-256
-		Salt              string            `yaml:"omitempty"`                   // Salt for encryption not included in the config file but in the binary
-		Path              string            `yaml:"path,omitempty"`              // Path to the where the collections and documents will be placed
-		Cache_timeout     float64           `yaml:"cache_timeout,omitempty"`     // Database cache timeout in seconds
-		Cache_limit       float64           `yaml:"cache_limit,omitempty"`       // Maximum number of documents cached at a given time, when exceeded the oldest document is removed
-		Replication_pass  string            `yaml:"replication_pass,omitempty"`  // Replication Password
-		Replication_nodes map[string]string `yaml:"replication_nodes,omitempty"` // List of nodes that replicates the database
-		Replication_port  int               `yaml:"replication_port,omitempty"`  // Port used replication
+		Encryption_key    string             `yaml:"encryption_key,omitempty"`    // Database encryption key must be 32 characters long for AES-256
+		Salt              string             `yaml:"omitempty"`                   // Salt for encryption not included in the config file but in the binary
+		Path              string             `yaml:"path,omitempty"`              // Path to the where the collections and documents will be placed
+		Cache_timeout     float64            `yaml:"cache_timeout,omitempty"`     // Database cache timeout in seconds
+		Cache_timeouts    map[string]float64 `yaml:"cache_timeouts,omitempty"`    // Cache timeout in seconds by collection name, overrides Cache_timeout
+		Cache_limit       int                `yaml:"cache_limit,omitempty"`       // Maximum number of documents cached at a given time, when exceeded a document is evicted based on Cache_policy
+		Cache_max_bytes   int64              `yaml:"cache_max_bytes,omitempty"`   // Maximum size of cached documents in bytes, 0 for no limit
+		Cache_policy      string             `yaml:"cache_policy,omitempty"`      // Cache eviction policy, LRU (default) or LFU
+		Query_cache_limit int                `yaml:"query_cache_limit,omitempty"` // Maximum number of cached query results, negative to disable query caching
+		Replication_pass  string             `yaml:"replication_pass,omitempty"`  // Replication Password
+		Replication_nodes map[string]string  `yaml:"replication_nodes,omitempty"` // List of nodes that replicates the database
+		Replication_port  int                `yaml:"replication_port,omitempty"`  // Port used replication
+		Sub_buffer        int                `yaml:"sub_buffer,omitempty"`        // Default number of snapshots queued per subscription
+		Sub_policy        string             `yaml:"sub_policy,omitempty"`        // Default policy when a subscription's buffer is full, COALESCE, DROP_OLDEST or DISCONNECT
+		Read_only         bool               `yaml:"read_only,omitempty"`         // Open the database without taking the directory lock, can be used while another process has it open for writing
+		Durability        string             `yaml:"durability,omitempty"`        // Flushing of written documents to disk, NONE (default), FILE or FULL
+		Storage           string             `yaml:"storage,omitempty"`           // Storage backend, DIRECTORY (default), MEMORY, FILE or LOG
+		Log_segment_size  int64              `yaml:"log_segment_size,omitempty"`  // Size in bytes at which the LOG storage starts a new segment
+		Log_compaction    float64            `yaml:"log_compaction,omitempty"`    // Interval in seconds between checks for LOG storage segments to compact
+		Scan_workers      int                `yaml:"scan_workers,omitempty"`      // Number of documents a query reads concurrently, defaults to the number of CPUs
+		Slow_query        float64            `yaml:"slow_query,omitempty"`        // Queries taking longer in seconds are logged with their plan, 0 disables the log
+		Search_indexes    []string           `yaml:"search_indexes,omitempty"`    // Collections with a full-text search index, see Collection.Search
+		Storage_backend   Storage            `yaml:"-"`                           // Custom storage backend, overrides Storage
 	}
 )
 
+var (
+	// ErrClosed is returned by every operation on a driver after Close was called
+	ErrClosed = errors.New("database driver is closed")
+	// ErrLocked is returned by NewDB when the database directory is open in another process
+	ErrLocked = errors.New("database directory is locked by another process")
+	// ErrReadOnly is returned by write operations on a driver opened with Read_only
+	ErrReadOnly = errors.New("database is opened read-only")
+	// ErrDropped closes the subscriptions of a collection when the collection is dropped or renamed
+	ErrDropped = errors.New("collection has been dropped")
+	// ErrNotFound is returned when a document doesn't exist
+	ErrNotFound = errors.New("document not found")
+	// ErrInvalidID is returned when a document ID or collection path isn't valid
+	ErrInvalidID = errors.New("invalid ID")
+	// ErrConflict is returned when an operation conflicts with existing data, e.g. renaming a
+	// collection to one that has documents
+	ErrConflict = errors.New("conflict with existing data")
+	// ErrDecrypt is returned when a stored document can't be decrypted or decoded, usually
+	// because of a wrong encryption key
+	ErrDecrypt = errors.New("unable to decrypt document")
+	// ErrPermission is returned when the storage or a replication node denies access
+	ErrPermission = errors.New("permission denied")
+	// ErrTypeMismatch is returned when a filter value or operator doesn't fit the type of the
+	// document field it is applied to
+	ErrTypeMismatch = errors.New("filter type mismatch")
+)
+
+// Name of the lock file in the database directory
+const lock_file_name = "_lock"
+
 func ValidateID(id string) error {
 	if id == "" {
-		return fmt.Errorf("empty value")
+		return fmt.Errorf("%w - empty value", ErrInvalidID)
 	} else if id == "_logs" {
-		return fmt.Errorf("collection can not be called _logs")
+		return fmt.Errorf("%w - collection can not be called _logs", ErrInvalidID)
+	} else if id == lock_file_name {
+		return fmt.Errorf("%w - collection can not be called %s", ErrInvalidID, lock_file_name)
+	} else if id == log_storage_dir {
+		return fmt.Errorf("%w - collection can not be called %s", ErrInvalidID, log_storage_dir)
+	} else if strings.HasSuffix(id, tmp_suffix) {
+		return fmt.Errorf("%w - unsupported suffix, can't end with '%s'", ErrInvalidID, tmp_suffix)
+	} else if strings.HasSuffix(id, subcollections_suffix) {
+		return fmt.Errorf("%w - unsupported suffix, can't end with '%s'", ErrInvalidID, subcollections_suffix)
 	}
 
 	if strings.Contains(id, "/") || strings.Contains(id, `\`) {
-		return fmt.Errorf(`unsupported character, can't contain '/' or '\'`)
+		return fmt.Errorf(`%w - unsupported character, can't contain '/' or '\'`, ErrInvalidID)
 	}
 
 	return nil
 }
 
+// Validate the path of a collection, either a collection name or a subcollection path in the
+// form collection/document/subcollection with any number of levels
+func ValidateCollectionPath(path string) error {
+	parts := strings.Split(path, "/")
+	if len(parts)%2 == 0 {
+		return fmt.Errorf("%w - '%s' is not a collection path", ErrInvalidID, path)
+	}
+	for _, part := range parts {
+		if err := ValidateID(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Convert v interface object
 func (d Document) DataTo(v interface{}) error {
 	doc_b, err := json.Marshal(d.Data)
 	if err != nil {
-		return fmt.Errorf("Unable to marshal document data! " + err.Error())
+		return fmt.Errorf("Unable to marshal document data! %w", err)
 	}
 
 	return json.Unmarshal(doc_b, &v)
@@ -109,19 +197,106 @@ func LoadConfig(path_to_config_file string) (Config, error) {
 func NewDB(config Config) (*Driver, error) {
 	dir := filepath.Clean(config.Path)
 
-	// Check for timeout, if not set by user set default
-	var cache_limit float64
-	if config.Cache_limit == 0 {
+	// Check for limit, if not set by user set default
+	var cache_limit int
+	if config.Cache_limit <= 0 {
 		cache_limit = 1000
 	} else {
 		cache_limit = config.Cache_limit
 	}
 
-	// Check for limit, if not set by user set default
+	// Check for timeout, if not set by user set default
 	cache_timeout := time.Second * time.Duration(config.Cache_timeout)
 	if cache_timeout == 0 {
 		cache_timeout = time.Duration(time.Minute * 5)
 	}
+	cache_timeouts := make(map[string]time.Duration)
+	for collection, timeout := range config.Cache_timeouts {
+		if timeout <= 0 {
+			return nil, fmt.Errorf("cache timeout of collection '%s' must be greater than 0", collection)
+		}
+		cache_timeouts[collection] = time.Duration(timeout * float64(time.Second))
+	}
+
+	// Check cache policy, if not set by user set default
+	cache_policy := config.Cache_policy
+	if cache_policy == "" {
+		cache_policy = Cache_lru
+	} else if err := validateCachePolicy(cache_policy); err != nil {
+		return nil, err
+	}
+
+	// Check query cache limit, if not set by user set default
+	query_cache_limit := config.Query_cache_limit
+	if query_cache_limit == 0 {
+		query_cache_limit = 100
+	}
+
+	// Check subscription buffering, if not set by user set default
+	sub_buffer := config.Sub_buffer
+	if sub_buffer == 0 {
+		sub_buffer = 10
+	} else if sub_buffer < 0 {
+		return nil, fmt.Errorf("sub_buffer can't be negative")
+	}
+	sub_policy := config.Sub_policy
+	if sub_policy == "" {
+		sub_policy = Subscription_coalesce
+	} else if err := validateSubscriptionPolicy(sub_policy); err != nil {
+		return nil, err
+	}
+
+	// Check durability, if not set by user set default
+	durability := config.Durability
+	if durability == "" {
+		durability = Durability_none
+	} else if err := validateDurability(durability); err != nil {
+		return nil, err
+	}
+
+	// Check storage, if not set by user set default
+	storage := config.Storage
+	if storage == "" {
+		storage = Storage_directory
+	} else if err := validateStorage(storage); err != nil {
+		return nil, err
+	}
+
+	// Check log storage settings, if not set by user set default
+	log_segment_size := config.Log_segment_size
+	if log_segment_size == 0 {
+		log_segment_size = 64 << 20
+	} else if log_segment_size < 0 {
+		return nil, fmt.Errorf("log_segment_size can't be negative")
+	}
+	log_compaction := time.Duration(config.Log_compaction * float64(time.Second))
+	if log_compaction == 0 {
+		log_compaction = time.Minute
+	} else if log_compaction < 0 {
+		return nil, fmt.Errorf("log_compaction can't be negative")
+	}
+
+	// Check scan workers, if not set by user set default
+	scan_workers := config.Scan_workers
+	if scan_workers == 0 {
+		scan_workers = runtime.NumCPU()
+	} else if scan_workers < 0 {
+		return nil, fmt.Errorf("scan_workers can't be negative")
+	}
+
+	// Check slow query threshold
+	if config.Slow_query < 0 {
+		return nil, fmt.Errorf("slow_query can't be negative")
+	}
+
+	// Check the collections to keep a search index of
+	search := make(map[string]*search_index)
+	for _, collection_name := range config.Search_indexes {
+		if err := ValidateCollectionPath(collection_name); err != nil {
+			return nil, fmt.Errorf("search index collection validation error - %w", err)
+		}
+		search[collection_name] = newSearchIndex()
+	}
 
 	// hash encryption key to SHA256
 	var encryption_key []byte
@@ -140,32 +315,199 @@ func NewDB(config Config) (*Driver, error) {
 		encryption_key:    encryption_key[:],
 		dir:               dir,
 		mutexes:           make(map[string]*sync.Mutex),
-		cache:             cache{timeout: cache_timeout, limit: cache_limit, documents: make(map[string]cached_doc)},
+		cache:             newCache(cache_timeout, cache_timeouts, cache_limit, config.Cache_max_bytes, cache_policy),
+		queries:           newQueryCache(query_cache_limit),
 		doc_state:         make(map[string]doc_state),
 		subs:              make(map[string]*Subscription),
 		replication_hosts: replication_nodes_temp,
 		replication_pass:  config.Replication_pass,
 		replication_state: "SYNCING",
 		replication_port:  config.Replication_port,
+		sub_buffer:        sub_buffer,
+		sub_policy:        sub_policy,
+		read_only:         config.Read_only,
+		durability:        durability,
+		log_segment_size:  log_segment_size,
+		log_compaction:    log_compaction,
+		search:            search,
+		scan_workers:      scan_workers,
 	}
 
+	driver.SetSlowQueryThreshold(time.Duration(config.Slow_query * float64(time.Second)))
+
+	// Documents in memory don't need the database directory
+	in_memory := config.Storage_backend == nil && storage == Storage_memory
+
 	// if the database already exists, just use it
-	if _, err := os.Stat(dir); err != nil {
+	if _, err := os.Stat(dir); err != nil && !in_memory {
+		if driver.read_only {
+			return nil, fmt.Errorf("database directory '%s' doesn't exist", dir)
+		}
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return nil, err
 		}
 	}
 
+	// Take the directory lock so no other process writes to the database
+	if !driver.read_only && !in_memory {
+		if err := driver.lock(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Open storage backend
+	if config.Storage_backend != nil {
+		driver.storage = config.Storage_backend
+	} else {
+		var err error
+		driver.storage, err = driver.openStorage(storage)
+		if err != nil {
+			driver.unlock()
+			return nil, err
+		}
+	}
+
 	err := driver.loadDocState()
 	if err != nil {
-		return &driver, err
+		driver.storage.Close()
+		driver.unlock()
+		return nil, err
 	}
 	go driver.cache.runCachePurge()
-	go driver.runReplication()
+	// Read-only drivers don't take part in replication
+	if !driver.read_only {
+		driver.server = driver.replicationServer()
+		go driver.runReplication()
+	}
 
 	return &driver, nil
 }
 
+// Close stops accepting new operations, waits for in-flight writes and replication pushes to
+// finish, closes every subscription and stops the replication listener and cache purge.
+// If ctx is done before in-flight work finishes the driver is still closed and ctx's error
+// is returned. Every operation on a closed driver returns ErrClosed
+func (d *Driver) Close(ctx context.Context) error {
+	d.life_mutex.Lock()
+	if d.closed {
+		d.life_mutex.Unlock()
+		return ErrClosed
+	}
+	d.closed = true
+	d.life_mutex.Unlock()
+
+	// Stop the replication listener, waits for active replication requests
+	var shutdown_err error
+	if d.server != nil {
+		if err := d.server.Shutdown(ctx); err != nil {
+			shutdown_err = fmt.Errorf("unable to stop replication listener - %w", err)
+		}
+	}
+
+	// Wait for in-flight operations
+	drained := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(drained)
+	}()
+	var drain_err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		drain_err = ctx.Err()
+	}
+
+	// Close all subscriptions
+	d.closeSubscriptions("", ErrClosed)
+
+	d.cache.stop()
+
+	// Release document locks and the directory lock
+	d.mutex.Lock()
+	d.mutexes = make(map[string]*sync.Mutex)
+	d.mutex.Unlock()
+	storage_err := d.storage.Close()
+	unlock_err := d.unlock()
+
+	if drain_err != nil {
+		return drain_err
+	}
+	if shutdown_err != nil {
+		return shutdown_err
+	}
+	if storage_err != nil {
+		return fmt.Errorf("unable to close storage - %w", storage_err)
+	}
+	return unlock_err
+}
+
+// Take the exclusive lock on the database directory
+func (d *Driver) lock() error {
+	path := filepath.Join(d.dir, lock_file_name)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open lock file - %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return fmt.Errorf("%w, open it with read_only or close the other process - %s", ErrLocked, d.dir)
+		}
+		return fmt.Errorf("unable to lock database directory - %w", err)
+	}
+	d.lock_file = f
+	return nil
+}
+
+// Release the lock on the database directory if it is held
+func (d *Driver) unlock() error {
+	if d.lock_file == nil {
+		return nil
+	}
+	err := unlockFile(d.lock_file)
+	d.lock_file.Close()
+	d.lock_file = nil
+	if err != nil {
+		return fmt.Errorf("unable to unlock database directory - %w", err)
+	}
+	return nil
+}
+
+// Register an operation Close has to wait for, returns ErrClosed if the driver is closed.
+// Every successful call must be followed by a call to end
+func (d *Driver) begin() error {
+	d.life_mutex.RLock()
+	defer d.life_mutex.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	d.inflight.Add(1)
+	return nil
+}
+
+// Same as begin for operations that modify the database
+func (d *Driver) beginWrite() error {
+	if d.read_only {
+		return ErrReadOnly
+	}
+	return d.begin()
+}
+
+func (d *Driver) end() {
+	d.inflight.Done()
+}
+
+// Run fn in a go routine Close waits for, must be called between begin and end
+func (d *Driver) goTracked(fn func()) {
+	d.inflight.Add(1)
+	go func() {
+		defer d.inflight.Done()
+		fn()
+	}()
+}
+
+// Collection returns a collection by name, subcollections can be reached with their full path
+// (collection/document/subcollection) or with Collection.Doc
 func (d *Driver) Collection(name string) *Collection {
 	return &Collection{collection_name: name, driver: d}
 }
@@ -9,14 +9,13 @@ import (
 func EncryptAES(key []byte, data []byte) ([]byte, error) {
 	c, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create AES Cipher! " + err.Error())
+		return nil, fmt.Errorf("Unable to create AES Cipher! %w", err)
 	}
-	out := make([]byte, 1048576)
-
 	passes := len(data) / 16
 	if len(data) > passes*16 {
 		passes++
 	}
+	out := make([]byte, passes*16)
 
 	for i := 0; i < passes; i++ {
 		pass := make([]byte, 16)
@@ -40,22 +39,22 @@ func EncryptAES(key []byte, data []byte) ([]byte, error) {
 		}
 	}
 
-	return bytes.Trim(out, "\x00"), nil
+	// Cipher text isn't trimmed, it can start or end with zero bytes
+	return out, nil
 }
 
 func DecryptAES(key []byte, ciphertext []byte) ([]byte, error) {
 
 	c, err := aes.NewCipher(key)
 	if err != nil {
-		return ciphertext, fmt.Errorf("Unable to create AES Cipher " + err.Error())
+		return ciphertext, fmt.Errorf("Unable to create AES Cipher %w", err)
 	}
 
-	pt := make([]byte, 1048576)
-
 	passes := len(ciphertext) / 16
 	if len(ciphertext) > passes*16 {
 		passes++
 	}
+	pt := make([]byte, passes*16)
 	for i := 0; i < passes; i++ {
 		pass := make([]byte, 16)
 		data_to_decrypt := make([]byte, 16)
@@ -1,41 +1,77 @@
 package opendivdb
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
+	"io/fs"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-type Collection struct {
-	collection_name string
-	driver          *Driver
-	filter          Filter
+type (
+	Collection struct {
+		collection_name string // Collection name or path of a subcollection (collection/document/subcollection)
+		driver          *Driver
+		filter          Filter
+		fields          []string     // Fields returned by Documents, all fields if empty
+		order           []order_by   // Order of the documents returned by Documents, by ID if empty
+		stats           *query_stats // Set while a query runs to collect the statistics of the documents read
+	}
+
+	// Reference to a document of a collection, used to reach the document's subcollections
+	DocumentRef struct {
+		collection *Collection
+		id         string
+	}
+)
+
+// Doc returns a reference to a document of the collection, the document doesn't need to exist
+func (c *Collection) Doc(id string) *DocumentRef {
+	return &DocumentRef{collection: c, id: id}
+}
+
+// Collection returns a subcollection of the document
+func (r *DocumentRef) Collection(name string) *Collection {
+	return r.collection.driver.Collection(r.collection.collection_name + "/" + r.id + "/" + name)
 }
 
 // Write locks the database and attempts to write the record to the database under
 // the [collection] specified with the random document name (UUID). Name is added to document under [ID]
 func (c *Collection) Add(v interface{}) (Document, error) {
+	return c.AddContext(context.Background(), v)
+}
+
+// Same as Add, the document isn't written if ctx is done
+func (c *Collection) AddContext(ctx context.Context, v interface{}) (Document, error) {
 	new_id := uuid.NewString()
-	return c.Write(new_id, v)
+	return c.WriteContext(ctx, new_id, v)
 }
 
 // Write locks the database and attempts to write the record to the database under
 // the [collection] specified with the [document] name given
 func (c *Collection) Write(document string, v interface{}) (Document, error) {
-	err := ValidateID(c.collection_name)
+	return c.WriteContext(context.Background(), document, v)
+}
+
+// Same as Write, the document isn't written if ctx is done
+func (c *Collection) WriteContext(ctx context.Context, document string, v interface{}) (Document, error) {
+	if err := c.driver.beginWrite(); err != nil {
+		return Document{}, err
+	}
+	defer c.driver.end()
+
+	err := ValidateCollectionPath(c.collection_name)
 	if err != nil {
-		return Document{}, fmt.Errorf(`collection name validation error - ` + err.Error())
+		return Document{}, fmt.Errorf("collection name validation error - %w", err)
 	}
 
 	// ensure there is a document (name) to save record as
 	err = ValidateID(document)
 	if err != nil {
-		return Document{}, fmt.Errorf(`document ID validation error - ` + err.Error())
+		return Document{}, fmt.Errorf("document ID validation error - %w", err)
 	}
 
 	// marshal document to JSON with tab indents
@@ -43,6 +79,9 @@ func (c *Collection) Write(document string, v interface{}) (Document, error) {
 	if err != nil {
 		return Document{}, err
 	}
+	if err := ctx.Err(); err != nil {
+		return Document{}, err
+	}
 	// create document wrapping the data bytes
 	doc := Document{ID: document, Collection: c.collection_name, Data: v_b, Updated_at: time.Now(), Hash: GetMD5Hash(v_b), From_cache: false}
 	// Write document to disk
@@ -50,7 +89,7 @@ func (c *Collection) Write(document string, v interface{}) (Document, error) {
 	if err != nil {
 		return doc, err
 	}
-	go c.driver.sendDocToAllNodes(doc)
+	c.driver.goTracked(func() { c.driver.sendDocToAllNodes(doc) })
 
 	return doc, nil
 }
@@ -61,60 +100,60 @@ func (c *Collection) write(document_id string, doc Document) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	dir := filepath.Join(c.driver.dir, c.collection_name)
-	fnlPath := filepath.Join(dir, document_id)
-	tmpPath := fnlPath + ".tmp"
-
-	// create collection directory
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-
-	b, err := json.MarshalIndent(doc, "", "\t")
+	b, err := c.driver.encodeDocument(doc)
 	if err != nil {
 		return err
 	}
-
-	// check if encryption is enabled and encrypt entire document before writing it to disk
-	if len(c.driver.encryption_key) != 0 {
-		b, err = EncryptAES(c.driver.encryption_key, b)
-		if err != nil {
-			return err
-		}
-	}
-	// write document bytes to the disk
-	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+	terms, err := c.driver.indexTerms(c.collection_name, doc)
+	if err != nil {
 		return err
 	}
 
-	// move final file into place
-	err = os.Rename(tmpPath, fnlPath)
-	if err != nil {
-		return err
+	// write document bytes to storage
+	if err := c.driver.storage.Write(c.collection_name, document_id, b); err != nil {
+		return storageError(err)
 	}
 
+	// Update the collection's search index
+	c.driver.indexDocument(c.collection_name, document_id, terms)
 	// add the new document to cache
-	c.driver.cache.add(*c, doc)
+	c.driver.cache.add(c.collection_name, doc)
 	// Update in memory document state
 	c.driver.setDocState(c.collection_name, doc)
+	// Remove cached query results this document affects
+	c.driver.queries.invalidate(c.collection_name, doc)
 	// Push change to subscribers
-	go c.driver.checkSubscriptionPush(c.collection_name, doc)
+	c.driver.goTracked(func() { c.driver.checkSubscriptionPush(c.collection_name, doc) })
 
 	return nil
 }
 
 // Read a document from the database or Cache
 func (c *Collection) Document(id string) (Document, error) {
+	return c.DocumentContext(context.Background(), id)
+}
+
+// Same as Document, returns ctx's error if it is done
+func (c *Collection) DocumentContext(ctx context.Context, id string) (Document, error) {
+	if err := c.driver.begin(); err != nil {
+		return Document{}, err
+	}
+	defer c.driver.end()
+
+	if err := ctx.Err(); err != nil {
+		return Document{}, err
+	}
+
 	// ensure there is a place to save record
-	err := ValidateID(c.collection_name)
+	err := ValidateCollectionPath(c.collection_name)
 	if err != nil {
-		return Document{}, fmt.Errorf(`collection name validation error - ` + err.Error())
+		return Document{}, fmt.Errorf("collection name validation error - %w", err)
 	}
 
 	// ensure there is a document (name) to save record as
 	err = ValidateID(id)
 	if err != nil {
-		return Document{}, fmt.Errorf(`document ID validation error - ` + err.Error())
+		return Document{}, fmt.Errorf("document ID validation error - %w", err)
 	}
 
 	return c.read(id)
@@ -122,150 +161,344 @@ func (c *Collection) Document(id string) (Document, error) {
 
 // Internal function to read document from collection
 func (c *Collection) read(id string) (Document, error) {
-	// check if document exist in cache, if yes return the document from cache
-	if doc, in_cache := c.driver.cache.getDoc(c.collection_name, id); in_cache {
-		return doc, nil
+	// check if document exist in cache, if yes return the document from cache. Read-only
+	// drivers don't cache as another process may be writing to the database
+	c.stats.scan()
+	if !c.driver.read_only {
+		if doc, in_cache := c.driver.cache.getDoc(c.collection_name, id); in_cache {
+			c.stats.cacheHit()
+			return doc, nil
+		}
 	}
 
-	// check to see if collection (directory) exists
-	dir := filepath.Join(c.driver.dir, c.collection_name)
-	if _, err := stat(dir); err != nil {
-		return Document{}, nil
+	// read record from storage
+	b, err := c.driver.storage.Read(c.collection_name, id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Document{}, fmt.Errorf("document '%s' doesn't exist in '%s' - %w", id, c.collection_name, ErrNotFound)
+	} else if err != nil {
+		return Document{}, storageError(err)
 	}
 
-	// Check to see if file exists
-	record := filepath.Join(c.driver.dir, c.collection_name, id)
-	if _, err := stat(record); err != nil {
-		return Document{}, fmt.Errorf("document '" + id + "' doesn't exist in '" + c.collection_name + "'")
+	decrypt_start := time.Now()
+	doc, err := c.driver.decodeDocument(b)
+	c.stats.decrypt(time.Since(decrypt_start))
+	if err != nil {
+		return Document{}, err
 	}
 
-	// read record from database
-	b, err := os.ReadFile(record)
+	// Add document to cache
+	if !c.driver.read_only {
+		c.driver.cache.add(c.collection_name, doc)
+	}
+
+	return doc, nil
+}
+
+// ReadAll documents from a collection; this is returned as a Collection. Documents are sorted
+// as set with OrderBy and if fields were selected with Select the Data of the returned
+// documents only holds those fields
+func (c *Collection) Documents() ([]Document, error) {
+	return c.DocumentsContext(context.Background())
+}
+
+// Same as Documents, reading documents stops with ctx's error once it is done
+func (c *Collection) DocumentsContext(ctx context.Context) ([]Document, error) {
+	col, err := c.documents(ctx)
 	if err != nil {
-		return Document{}, err
+		return col, err
 	}
+	if len(c.order) > 0 {
+		if col, err = sortDocuments(col, c.order); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.fields) > 0 {
+		return projectDocuments(col, c.fields)
+	}
+	return col, nil
+}
 
-	// if encryption is enabled decrypt document bytes
-	if len(c.driver.encryption_key) != 0 {
-		b, err = DecryptAES(c.driver.encryption_key, b[:])
-		if err != nil {
-			return Document{}, err
+// Internal function to read the documents matching the filter with all of their fields
+func (c *Collection) documents(ctx context.Context) ([]Document, error) {
+	col, _, err := c.runQuery(ctx)
+	return col, err
+}
+
+// Read the documents matching the filter and report how they were found
+func (c *Collection) runQuery(ctx context.Context) ([]Document, QueryPlan, error) {
+	start := time.Now()
+	plan := QueryPlan{Collection: c.collection_name, Filter: c.filter.key()}
+	if err := c.driver.begin(); err != nil {
+		return nil, plan, err
+	}
+	defer c.driver.end()
+
+	if err := ctx.Err(); err != nil {
+		return nil, plan, err
+	}
+	if c.filter.err != nil {
+		return nil, plan, c.filter.err
+	}
+
+	// Return the result of the same query if nothing changed since it was cached
+	if !c.driver.read_only {
+		if col, in_cache := c.driver.queries.get(c.collection_name, c.filter); in_cache {
+			plan.Plan = Plan_query_cache
+			plan.Returned = len(col)
+			plan.Duration = time.Since(start)
+			c.driver.logSlowQuery(plan)
+			return col, plan, nil
 		}
 	}
-	// unmarshall bytes into Document
-	doc := Document{}
-	err = json.Unmarshal(b, &doc)
+	generation := c.driver.queries.generation(c.collection_name)
+
+	// Run the query on a copy collecting the statistics of the documents read
+	query := *c
+	query.stats = &query_stats{}
+	var (
+		col []Document
+		err error
+	)
+	// Check if filter is specified, use filtered function
+	if c.filter.isSet() {
+		plan.Plan = Plan_full_scan
+		if c.filter.onlyMetadata() && !c.driver.read_only {
+			plan.Plan = Plan_metadata_index
+		}
+		col, err = query.filteredDocuments(ctx)
+	} else {
+		plan.Plan = Plan_full_scan
+		col, err = query.allDocuments(ctx)
+	}
+	plan.Scanned = int(query.stats.scanned.Load())
+	plan.Cache_hits = int(query.stats.cache_hits.Load())
+	plan.Decrypt_time = time.Duration(query.stats.decrypt_time.Load())
+	plan.Returned = len(col)
+	plan.Duration = time.Since(start)
 	if err != nil {
-		return Document{}, err
+		return col, plan, err
 	}
+	c.driver.logSlowQuery(plan)
 
-	// Add document to cache
-	c.driver.cache.add(*c, doc)
+	if !c.driver.read_only {
+		c.driver.queries.add(c.collection_name, c.filter, generation, col)
+	}
+	return col, plan, nil
+}
 
-	return doc, nil
+// IDs returns the IDs of the collection's documents in ascending order. Documents are only
+// read when a filter is set on fields of their data
+func (c *Collection) IDs() ([]string, error) {
+	if c.filter.isSet() && (!c.filter.onlyMetadata() || c.driver.read_only || c.filter.err != nil) {
+		col, err := c.documents(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, 0, len(col))
+		for _, doc := range col {
+			ids = append(ids, doc.ID)
+		}
+		return ids, nil
+	}
+
+	if err := c.driver.begin(); err != nil {
+		return nil, err
+	}
+	defer c.driver.end()
+
+	if err := ValidateCollectionPath(c.collection_name); err != nil {
+		return nil, fmt.Errorf("collection name validation error - %w", err)
+	}
+
+	ids, err := c.driver.storage.List(c.collection_name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !c.filter.isSet() {
+		return ids, nil
+	}
+
+	// Metadata filters are answered from the document state, documents without a state are read
+	matching := make([]string, 0, len(ids))
+	for _, id := range ids {
+		included, ok, err := c.stateMatching(id)
+		if err == nil && !ok {
+			_, included, err = c.readMatching(id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if included {
+			matching = append(matching, id)
+		}
+	}
+	return matching, nil
 }
 
-// ReadAll documents from a collection; this is returned as a Collection.
-func (c *Collection) Documents() ([]Document, error) {
-	// Check if filter is specified, use filtered function
-	if c.filter.field != "" {
-		return c.filteredDocuments()
-	} else {
-		return c.allDocuments()
+// Count returns the number of documents in the collection, matching the filter if one is set.
+// Documents are only read when a filter is set on fields of their data
+func (c *Collection) Count() (int, error) {
+	ids, err := c.IDs()
+	if err != nil {
+		return 0, err
 	}
+	return len(ids), nil
 }
 
-func (c *Collection) allDocuments() ([]Document, error) {
+// Exists checks if a document exists without reading it
+func (c *Collection) Exists(id string) (bool, error) {
+	if err := c.driver.begin(); err != nil {
+		return false, err
+	}
+	defer c.driver.end()
+
+	err := ValidateCollectionPath(c.collection_name)
+	if err != nil {
+		return false, fmt.Errorf("collection name validation error - %w", err)
+	}
+	err = ValidateID(id)
+	if err != nil {
+		return false, fmt.Errorf("document ID validation error - %w", err)
+	}
+
+	// The document state is kept up to date with every write, read-only drivers check the
+	// storage as another process may be writing to the database
+	if !c.driver.read_only {
+		_, ok := c.driver.getDocState(c.collection_name, id)
+		return ok, nil
+	}
+	_, err = c.driver.storage.Read(c.collection_name, id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *Collection) allDocuments(ctx context.Context) ([]Document, error) {
 	var col []Document
 	// ensure there is a collection to read
 	if c.collection_name == "" {
 		return col, fmt.Errorf("missing collection - unable to record location")
 	}
 
-	if strings.Contains(c.collection_name, "/") || strings.Contains(c.collection_name, `\`) {
-		return col, fmt.Errorf(`unsupported character in collection name, collection name can't contain '/' or '\'`)
+	if err := ValidateCollectionPath(c.collection_name); err != nil {
+		return col, fmt.Errorf("collection name validation error - %w", err)
 	}
 
-	// check to see if collection (directory) exists
-	dir := filepath.Join(c.driver.dir, c.collection_name)
-	if _, err := stat(dir); err != nil {
+	// list the documents of the collection, a collection that doesn't exist has no documents
+	ids, err := c.driver.storage.List(c.collection_name)
+	if errors.Is(err, fs.ErrNotExist) {
 		return col, nil
+	} else if err != nil {
+		return col, storageError(err)
 	}
 
-	// read all the files in the transaction.Collection; an error here just means
-	// the collection is either empty or doesn't exist
-	files, _ := os.ReadDir(dir)
-
-	// iterate over each of the files, attempting to read the file. If successful
-	// append the files to the collection of read files
-	for _, file := range files {
-		doc, err := c.Document(file.Name())
+	// read the documents with the scan workers, in the order they are listed
+	return c.scanDocuments(ctx, ids, func(id string) (Document, bool, error) {
+		doc, err := c.Document(id)
 		if err != nil {
-			return col, fmt.Errorf("unable to read file "+file.Name(), false, true)
+			return Document{}, false, fmt.Errorf("unable to read document '%s' - %w", id, err)
 		}
-
-		// append read file
-		col = append(col, doc)
-	}
-	return col, nil
+		return doc, true, nil
+	})
 }
 
 // Delete locks that database and then attempts to remove the collection/document
-// specified by [path]
+// specified by [path], documents of the document's subcollections are deleted as well
 func (c *Collection) Delete(id string) error {
-	err := ValidateID(c.collection_name)
+	return c.DeleteContext(context.Background(), id)
+}
+
+// Same as Delete, stops with ctx's error once it is done. Documents of subcollections deleted
+// before ctx was done stay deleted
+func (c *Collection) DeleteContext(ctx context.Context, id string) error {
+	if err := c.driver.beginWrite(); err != nil {
+		return err
+	}
+	defer c.driver.end()
+
+	err := ValidateCollectionPath(c.collection_name)
 	if err != nil {
-		return fmt.Errorf(`collection name validation error - ` + err.Error())
+		return fmt.Errorf("collection name validation error - %w", err)
 	}
 
 	// ensure there is a document (name) to save record as
 	err = ValidateID(id)
 	if err != nil {
-		return fmt.Errorf(`document ID validation error - ` + err.Error())
+		return fmt.Errorf("document ID validation error - %w", err)
+	}
+
+	// delete the documents of the document's subcollections at any depth
+	collections, err := c.driver.subcollections(c.collection_name + "/" + id)
+	if err != nil {
+		return err
+	}
+	for _, collection_name := range collections {
+		sub := c.driver.Collection(collection_name)
+		ids, err := c.driver.storage.List(collection_name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("unable to list documents of subcollection '%s' - %w", collection_name, storageError(err))
+		}
+		for _, sub_id := range ids {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := sub.delete(sub_id); err != nil {
+				return err
+			}
+		}
 	}
 
-	path := filepath.Join(c.collection_name, id)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.delete(id)
+}
+
+// Internal function to delete a document from collection, its subcollections are not deleted
+func (c *Collection) delete(id string) error {
 	mutex := c.driver.getOrCreateMutex(c.collection_name + "/" + id)
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	dir := filepath.Join(c.driver.dir, path)
-
-	switch fi, err := stat(dir); {
-
-	// if fi is nil or error is not nil return
-	case fi == nil:
-		return nil
-
-	case err != nil:
-		return fmt.Errorf(err.Error())
-
-	// remove directory and all contents
-	case fi.Mode().IsDir():
-		// read all the files in the transaction.Collection;
-		return fmt.Errorf("deletion of entire collection is not allowed")
-
-	// remove file
-	case fi.Mode().IsRegular():
-		doc, err := c.Document(id)
-		if err != nil {
-			return fmt.Errorf("unable to retrieve document for subscription push check " + err.Error())
-		}
-		err = os.RemoveAll(dir)
-		if err != nil {
-			return fmt.Errorf("unable to delete document from OS " + err.Error())
-		}
-		c.driver.cache.delete(c.collection_name, id)
-		c.driver.removeDocState(c.collection_name, id)
-		go c.driver.checkSubscriptionPush(c.collection_name, doc)
+	// read the document for the subscription push check, nothing to do if it doesn't exist
+	doc, err := c.read(id)
+	if errors.Is(err, ErrNotFound) {
 		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to retrieve document for subscription push check - %w", err)
 	}
 
+	err = c.driver.storage.Delete(c.collection_name, id)
+	if err != nil {
+		return fmt.Errorf("unable to delete document from storage - %w", storageError(err))
+	}
+	c.driver.cache.delete(c.collection_name, id)
+	c.driver.removeDocState(c.collection_name, id)
+	c.driver.unindexDocument(c.collection_name, id)
+	c.driver.queries.invalidate(c.collection_name, doc)
+	c.driver.goTracked(func() { c.driver.checkSubscriptionPush(c.collection_name, doc) })
 	return nil
 }
 
-// Creates Filter object so do simple queries
+// Select the fields returned by Documents, nested fields are selected with a dot separated
+// path (e.g. "address.city"). Filters and the document hash still use every field
+func (c *Collection) Select(fields ...string) *Collection {
+	c.fields = fields
+	return c
+}
+
+// Creates Filter object so do simple queries, see filter_operators for the accepted operators
 func (c *Collection) Where(field string, operator string, value any) *Collection {
-	c.filter = Filter{field: field, operator: operator, value: value}
+	c.filter = newFilter(field, operator, value)
 	return c
 }
@@ -0,0 +1,94 @@
+package opendivdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Durability levels of document writes
+const (
+	Durability_none = "NONE" // Leave flushing to the operating system, a crash can lose recent writes
+	Durability_file = "FILE" // Flush each document file to disk before it is moved into place
+	Durability_full = "FULL" // Flush the document file and the collection directory so the rename survives a crash
+)
+
+// Suffix of the file a document is written to before it is moved into place
+const tmp_suffix = ".tmp"
+
+func validateDurability(durability string) error {
+	switch durability {
+	case Durability_none, Durability_file, Durability_full:
+		return nil
+	}
+	return fmt.Errorf("durability '%s' is not supported. Accepted values %s, %s, %s", durability, Durability_none, Durability_file, Durability_full)
+}
+
+// Marshal a document and encrypt it if encryption is enabled
+func (d *Driver) encodeDocument(doc Document) ([]byte, error) {
+	b, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	// check if encryption is enabled and encrypt entire document before writing it to disk
+	if len(d.encryption_key) != 0 {
+		b, err = EncryptAES(d.encryption_key, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Decrypt a document if encryption is enabled and unmarshal it
+func (d *Driver) decodeDocument(b []byte) (Document, error) {
+	var err error
+	// if encryption is enabled decrypt document bytes
+	if len(d.encryption_key) != 0 {
+		b, err = DecryptAES(d.encryption_key, b[:])
+		if err != nil {
+			return Document{}, fmt.Errorf("%w - %w", ErrDecrypt, err)
+		}
+	}
+	// unmarshall bytes into Document
+	doc := Document{}
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		return Document{}, fmt.Errorf("%w - %w", ErrDecrypt, err)
+	}
+	return doc, nil
+}
+
+// Write a file, flushing it to disk when sync is set
+func writeFile(path string, b []byte, sync bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err = f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// Flush a directory's entries to disk, directories can't be flushed on Windows
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
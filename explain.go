@@ -0,0 +1,82 @@
+package opendivdb
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// How the documents of a query were found
+const (
+	Plan_query_cache    = "QUERY_CACHE"    // Result of the same query was cached
+	Plan_metadata_index = "METADATA_INDEX" // Metadata filter checked against the in-memory document state, only matching documents are read
+	Plan_full_scan      = "FULL_SCAN"      // Every document of the collection is read
+)
+
+type (
+	// QueryPlan reports how a query was run and what it cost
+	QueryPlan struct {
+		Collection   string
+		Filter       string        // Filter as text, empty without a filter
+		Plan         string        // QUERY_CACHE, METADATA_INDEX or FULL_SCAN
+		Scanned      int           // Documents read
+		Returned     int           // Documents matching the filter
+		Cache_hits   int           // Documents read from the document cache
+		Decrypt_time time.Duration // Time spent decrypting and decoding documents read from storage
+		Duration     time.Duration // Time taken by the whole query
+	}
+
+	// Statistics collected while a query reads documents, documents may be read concurrently
+	query_stats struct {
+		scanned      atomic.Int64
+		cache_hits   atomic.Int64
+		decrypt_time atomic.Int64 // Nanoseconds
+	}
+)
+
+// Explain runs the query the way Documents does and reports how the documents were found
+func (c *Collection) Explain() (QueryPlan, error) {
+	_, plan, err := c.runQuery(context.Background())
+	return plan, err
+}
+
+func (p QueryPlan) String() string {
+	return fmt.Sprintf("collection '%s' filter '%s' plan %s scanned %d returned %d cache hits %d decrypt time %s took %s",
+		p.Collection, p.Filter, p.Plan, p.Scanned, p.Returned, p.Cache_hits, p.Decrypt_time, p.Duration)
+}
+
+// Count a document read by the query, stats may be nil when the read isn't part of a query
+func (s *query_stats) scan() {
+	if s != nil {
+		s.scanned.Add(1)
+	}
+}
+
+// Count a document read from the document cache
+func (s *query_stats) cacheHit() {
+	if s != nil {
+		s.cache_hits.Add(1)
+	}
+}
+
+// Add the time spent decoding a document read from storage
+func (s *query_stats) decrypt(duration time.Duration) {
+	if s != nil {
+		s.decrypt_time.Add(int64(duration))
+	}
+}
+
+// SetSlowQueryThreshold logs every query taking longer than threshold with its plan, 0 disables
+// the log
+func (d *Driver) SetSlowQueryThreshold(threshold time.Duration) {
+	d.slow_query.Store(int64(threshold))
+}
+
+// Log the query if it took longer than the slow query threshold
+func (d *Driver) logSlowQuery(plan QueryPlan) {
+	threshold := time.Duration(d.slow_query.Load())
+	if threshold > 0 && plan.Duration > threshold {
+		fmt.Println("[WARNING] slow query - " + plan.String())
+	}
+}
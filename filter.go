@@ -1,105 +1,267 @@
 package opendivdb
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 )
 
 type Filter struct {
-	field    string // Filed to filter by
-	operator string // Accepted conditions ==, <=, >=, !=, >, <. Comparison is done in the following format: [field] [operator] [value]
-	value    any    // Value of condition
+	field    string         // Filed to filter by
+	operator string         // Accepted conditions are listed in filter_operators. Comparison is done in the following format: [field] [operator] [value]
+	value    any            // Value of condition
+	regex    *regexp.Regexp // Compiled value of regex conditions
+	logic    string         // AND or OR when the filter combines filters instead of being a condition
+	filters  []Filter       // Filters combined by logic
+	err      error          // Error compiling the regex or parsing the query, returned when the filter is applied
+}
+
+// Ways filters are combined
+const (
+	filter_and = "AND"
+	filter_or  = "OR"
+)
+
+// Field names of document metadata in filters and ordering, fields with the same names in
+// the document's data can't be filtered on
+const (
+	Field_id         = "__id"         // Document ID
+	Field_updated_at = "__updated_at" // Update time, a RFC3339 formatted string when not compared to a time.Time
+	Field_hash       = "__hash"       // Hash of the document's data
+)
+
+// Accepted filter operators
+var filter_operators = []string{
+	"==", "<=", ">=", "!=", "<", ">",
+	"in", "not-in", // Field equals one of the values of a slice, or none of them
+	"array-contains", "array-contains-any", // Array field holds the value, or one of the values of a slice
+	"prefix", "prefix-i", "contains", "contains-i", "regex", "regex-i", // String matching, -i variants ignore case. contains also matches the elements of an array
+	"exists", "not-exists", // Field is set in the document or not, the value is ignored
+}
+
+// Build a filter, regex conditions are compiled once here
+func newFilter(field string, operator string, value any) Filter {
+	f := Filter{field: field, operator: operator, value: value}
+	if operator == "regex" || operator == "regex-i" {
+		pattern, ok := value.(string)
+		if !ok {
+			f.err = fmt.Errorf("%w - regex filter value must be a string", ErrTypeMismatch)
+			return f
+		}
+		if operator == "regex-i" {
+			pattern = "(?i)" + pattern
+		}
+		f.regex, f.err = regexp.Compile(pattern)
+	}
+	return f
 }
 
 // Filtered documents
-func (c *Collection) filteredDocuments() ([]Document, error) {
+func (c *Collection) filteredDocuments(ctx context.Context) ([]Document, error) {
 	// Filtered docs
 	var col []Document
 	// ensure there is a collection to read
 	if c.collection_name == "" {
 		return col, fmt.Errorf("missing collection - unable to record location")
 	}
+	if err := ValidateCollectionPath(c.collection_name); err != nil {
+		return col, fmt.Errorf("collection name validation error - %w", err)
+	}
 
-	dir := filepath.Join(c.driver.dir, c.collection_name)
-
-	// check to see if collection (directory) exists
-	if _, err := stat(dir); err != nil {
-		return col, err
+	// list the documents of the collection
+	ids, err := c.driver.storage.List(c.collection_name)
+	if err != nil {
+		return col, storageError(err)
 	}
 
-	// read all the files in the transaction.Collection; an error here just means
-	// the collection is either empty or doesn't exist
-	files, _ := os.ReadDir(dir)
+	// read and filter the documents with the scan workers, in the order they are listed
+	return c.scanDocuments(ctx, ids, c.readMatching)
+}
 
-	// iterate over each of the files, attempting to read the file. If successful
-	// append the files to the collection of read files
-	for _, file := range files {
-		doc, err := c.Document(file.Name())
+// Read a document and check if it matches the filter, every document matches without a filter
+func (c *Collection) readMatching(id string) (Document, bool, error) {
+	// Metadata filters are checked against the document state first so only the matching
+	// documents are read. Read-only drivers don't have an up to date document state
+	if c.filter.onlyMetadata() && !c.driver.read_only {
+		included, ok, err := c.stateMatching(id)
 		if err != nil {
-			return col, fmt.Errorf("unable to read file "+file.Name(), false, true)
+			return Document{}, false, err
 		}
-		included, err := c.filter.included(doc)
-		if err != nil {
-			return col, fmt.Errorf("error filtering document " + err.Error())
+		if ok && !included {
+			return Document{}, false, nil
 		}
-		if included {
-			col = append(col, doc)
+	}
+
+	doc, err := c.Document(id)
+	if err != nil {
+		return Document{}, false, fmt.Errorf("unable to read document '%s' - %w", id, err)
+	}
+	if !c.filter.isSet() {
+		return doc, true, nil
+	}
+	included, err := c.filter.included(doc)
+	if err != nil {
+		return Document{}, false, fmt.Errorf("error filtering document - %w", err)
+	}
+	return doc, included, nil
+}
+
+// Check a metadata filter against the document state without reading the document, ok is
+// false when the document has no state
+func (c *Collection) stateMatching(id string) (bool, bool, error) {
+	state, ok := c.driver.getDocState(c.collection_name, id)
+	if !ok {
+		return false, false, nil
+	}
+	included, err := c.filter.included(Document{ID: id, Collection: c.collection_name, Updated_at: state.Timestamp, Hash: state.Hash, Data: json.RawMessage("{}")})
+	if err != nil {
+		return false, true, fmt.Errorf("error filtering document - %w", err)
+	}
+	return included, true, nil
+}
+
+// Check if a filter was set
+func (f Filter) isSet() bool {
+	return f.field != "" || f.logic != "" || f.err != nil
+}
+
+// Check if a filter only has conditions on metadata fields
+func (f Filter) onlyMetadata() bool {
+	if f.logic == "" {
+		return isMetadataField(f.field)
+	}
+	for _, child := range f.filters {
+		if !child.onlyMetadata() {
+			return false
 		}
 	}
-	return col, nil
+	return true
 }
 
-func (f *Filter) included(doc Document) (bool, error) {
-	// Accepted operators
-	operators := map[string]bool{
-		"==": true,
-		"<=": true,
-		">=": true,
-		"!=": true,
-		"<":  true,
-		">":  true}
+// Unique key of the filter used to cache query results
+func (f Filter) key() string {
+	// Filters that failed to build never match a filter that was built
+	if f.err != nil {
+		return fmt.Sprintf("error(%q)", f.err.Error())
+	}
+	if f.logic != "" {
+		keys := make([]string, len(f.filters))
+		for i, child := range f.filters {
+			keys[i] = child.key()
+		}
+		return "(" + strings.Join(keys, " "+f.logic+" ") + ")"
+	}
+	if f.field == "" {
+		return ""
+	}
+	// Go syntax quotes strings, including those inside slices, so values can't be mistaken for
+	// one another or for the logic of a group
+	return fmt.Sprintf("%q %s %T(%#v)", f.field, f.operator, f.value, f.value)
+}
 
-	// Check to make sure correct condition is provided
-	if _, ok := operators[f.operator]; !ok {
-		return false, fmt.Errorf("Filter '" + f.operator + "' is not supported. Accepted conditions ==, <=, >=, !=, <, > ")
+func (f *Filter) included(doc Document) (bool, error) {
+	if f.err != nil {
+		return false, f.err
 	}
 	// Marshal document data into generic map for comparison
 	var d map[string]interface{}
 	if err := json.Unmarshal(doc.Data, &d); err != nil {
-		panic(err)
+		return false, fmt.Errorf("unable to un-marshall document '%s' - %w", doc.ID, err)
+	}
+	return f.match(doc, d)
+}
+
+// Apply the filter to a document and its decoded data
+func (f *Filter) match(doc Document, d map[string]any) (bool, error) {
+	if f.logic != "" {
+		for i := range f.filters {
+			included, err := f.filters[i].match(doc, d)
+			if err != nil {
+				return false, err
+			}
+			if f.logic == filter_and && !included {
+				return false, nil
+			} else if f.logic == filter_or && included {
+				return true, nil
+			}
+		}
+		return f.logic == filter_and, nil
+	}
+
+	// Check to make sure correct condition is provided
+	if !slices.Contains(filter_operators, f.operator) {
+		return false, fmt.Errorf("Filter '%s' is not supported. Accepted conditions %s", f.operator, strings.Join(filter_operators, ", "))
+	}
+	if f.err != nil {
+		return false, f.err
+	}
+
+	// Find field, operators that don't depend on the type of the field are applied first
+	value, exists := fieldValue(doc, d, f.field)
+	switch f.operator {
+	case "exists":
+		return exists, nil
+	case "not-exists":
+		return !exists, nil
+	case "in", "not-in":
+		values, err := filterValues(f.value)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+		in := slices.ContainsFunc(values, func(v any) bool { return valuesEqual(value, v) })
+		return in == (f.operator == "in"), nil
+	case "array-contains", "array-contains-any":
+		values := []any{f.value}
+		if f.operator == "array-contains-any" {
+			var err error
+			if values, err = filterValues(f.value); err != nil {
+				return false, err
+			}
+		}
+		array, ok := value.([]any)
+		if !ok {
+			return false, nil
+		}
+		for _, v := range values {
+			if slices.ContainsFunc(array, func(element any) bool { return valuesEqual(element, v) }) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "prefix", "prefix-i", "contains", "contains-i", "regex", "regex-i":
+		return matchString(value, f.operator, f.value, f.regex)
+	}
+
+	// Time filters compare RFC3339 formatted strings, Unix epoch numbers and the document's update time
+	if filter_t, ok := f.value.(time.Time); ok {
+		var doc_time time.Time
+		if f.field == Field_updated_at {
+			doc_time = doc.Updated_at
+		} else if value == nil {
+			return false, nil
+		} else {
+			var err error
+			if doc_time, err = parseTime(value); err != nil {
+				return false, err
+			}
+		}
+		return compareTime(doc_time, f.operator, filter_t), nil
 	}
 
-	// Find field
-	field := d[f.field]
 	// Check for provided field
-	if field != nil {
-		switch real := field.(type) {
+	if value != nil {
+		switch real := value.(type) {
 		case string:
 			switch filter_t := f.value.(type) {
-			case time.Time:
-				document_parsed_time, err := time.Parse(time.RFC3339Nano, real)
-				if err != nil {
-					return false, fmt.Errorf("document filed is RFC3339 formatted time but the filter isn't, unable to parse filter to date time")
-				}
-				switch f.operator {
-				case "<":
-					if document_parsed_time.Before(filter_t) {
-						return true, nil
-					}
-				case ">":
-					if document_parsed_time.After(filter_t) {
-						return true, nil
-					}
-				case "==":
-					if document_parsed_time.Equal(filter_t) {
-						return true, nil
-					}
-				default:
-					return false, fmt.Errorf("unsupported operator " + f.operator + " for time")
-				}
 			case string:
 				switch f.operator {
 				case "==":
@@ -111,36 +273,17 @@ func (f *Filter) included(doc Document) (bool, error) {
 						return true, nil
 					}
 				default:
-					return false, fmt.Errorf("unsupported operator " + f.operator + " for string")
+					return false, fmt.Errorf("%w - unsupported operator %s for string", ErrTypeMismatch, f.operator)
 				}
 			default:
-				return false, fmt.Errorf("document field and filter value are mismatched")
+				return false, fmt.Errorf("%w - document field and filter value are mismatched", ErrTypeMismatch)
 			}
 		case float64:
-			switch filter_t := f.value.(type) {
-			case int:
-				filter_t_float64 := float64(filter_t)
-				return compareFloat64(real, f.operator, filter_t_float64), nil
-			case int8:
-				filter_t_float64 := float64(filter_t)
-				return compareFloat64(real, f.operator, filter_t_float64), nil
-			case int16:
-				filter_t_float64 := float64(filter_t)
-				return compareFloat64(real, f.operator, filter_t_float64), nil
-			case int32:
-				filter_t_float64 := float64(filter_t)
-				return compareFloat64(real, f.operator, filter_t_float64), nil
-			case int64:
-				filter_t_float64 := float64(filter_t)
-				return compareFloat64(real, f.operator, filter_t_float64), nil
-			case float32:
-				filter_t_float64 := float64(filter_t)
-				return compareFloat64(real, f.operator, filter_t_float64), nil
-			case float64:
-				return compareFloat64(real, f.operator, filter_t), nil
-			default:
-				return false, fmt.Errorf("document field and filter value are mismatched")
+			filter_t, ok := toFloat64(f.value)
+			if !ok {
+				return false, fmt.Errorf("%w - document field and filter value are mismatched", ErrTypeMismatch)
 			}
+			return compareFloat64(real, f.operator, filter_t), nil
 		case bool:
 			switch filter_t := f.value.(type) {
 			case bool:
@@ -154,16 +297,182 @@ func (f *Filter) included(doc Document) (bool, error) {
 						return true, nil
 					}
 				default:
-					return false, fmt.Errorf("unsupported operator " + f.operator + " for bool")
+					return false, fmt.Errorf("%w - unsupported operator %s for bool", ErrTypeMismatch, f.operator)
 				}
 			default:
-				return false, fmt.Errorf("document field and filter value are mismatched")
+				return false, fmt.Errorf("%w - document field and filter value are mismatched", ErrTypeMismatch)
 			}
 		}
 	}
 	return false, nil
 }
 
+// Check if a field name is one of the document metadata fields
+func isMetadataField(field string) bool {
+	return field == Field_id || field == Field_updated_at || field == Field_hash
+}
+
+// Value of a field of a document, metadata fields are read from the document and other
+// fields from its decoded data
+func fieldValue(doc Document, d map[string]any, field string) (any, bool) {
+	switch field {
+	case Field_id:
+		return doc.ID, true
+	case Field_updated_at:
+		return doc.Updated_at.Format(time.RFC3339Nano), true
+	case Field_hash:
+		return doc.Hash, true
+	}
+	value, ok := d[field]
+	return value, ok
+}
+
+// Items of an in, not-in or array-contains-any filter value, which must be a slice or array
+func filterValues(value any) ([]any, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%w - filter value must be a slice, got %T", ErrTypeMismatch, value)
+	}
+	values := make([]any, v.Len())
+	for i := range values {
+		values[i] = v.Index(i).Interface()
+	}
+	return values, nil
+}
+
+// Compare a value decoded from a document with a filter value, numbers of any type are
+// compared as float64 and time.Time values with times and epoch numbers the way parseTime reads them
+func valuesEqual(doc_value any, filter_value any) bool {
+	if filter_t, ok := filter_value.(time.Time); ok {
+		parsed, err := parseTime(doc_value)
+		return err == nil && parsed.Equal(filter_t)
+	}
+	switch real := doc_value.(type) {
+	case float64:
+		number, ok := toFloat64(filter_value)
+		return ok && real == number
+	case string:
+		filter_t, ok := filter_value.(string)
+		return ok && real == filter_t
+	case bool:
+		filter_t, ok := filter_value.(bool)
+		return ok && real == filter_t
+	case nil:
+		return filter_value == nil
+	}
+	return false
+}
+
+// Convert a number of any type to float64
+func toFloat64(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Apply a string matching operator, documents where the field isn't a string are not included.
+// contains and contains-i on an array field match an element equal to the filter value
+func matchString(doc_value any, operator string, filter_value any, regex *regexp.Regexp) (bool, error) {
+	if array, ok := doc_value.([]any); ok && (operator == "contains" || operator == "contains-i") {
+		return slices.ContainsFunc(array, func(element any) bool {
+			if operator == "contains-i" {
+				element_t, element_ok := element.(string)
+				filter_t, filter_ok := filter_value.(string)
+				return element_ok && filter_ok && strings.EqualFold(element_t, filter_t)
+			}
+			return valuesEqual(element, filter_value)
+		}), nil
+	}
+	real, ok := doc_value.(string)
+	if !ok {
+		return false, nil
+	}
+	if regex != nil {
+		return regex.MatchString(real), nil
+	}
+	filter_t, ok := filter_value.(string)
+	if !ok {
+		return false, fmt.Errorf("%w - filter value of %s must be a string", ErrTypeMismatch, operator)
+	}
+	if strings.HasSuffix(operator, "-i") {
+		real = strings.ToLower(real)
+		filter_t = strings.ToLower(filter_t)
+	}
+	if strings.HasPrefix(operator, "prefix") {
+		return strings.HasPrefix(real, filter_t), nil
+	}
+	return strings.Contains(real, filter_t), nil
+}
+
+// Layouts of time strings accepted by time filters, tried in order
+var time_layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// Parse a document field compared to a time, either a string in one of time_layouts (UTC if
+// it has no time zone) or a Unix epoch number of seconds
+func parseTime(value any) (time.Time, error) {
+	switch real := value.(type) {
+	case string:
+		for _, layout := range time_layouts {
+			if parsed, err := time.Parse(layout, real); err == nil {
+				return parsed, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("document field '%s' is not a RFC3339 formatted time, unable to compare it to the filter's date time", real)
+	case float64:
+		seconds, fraction := math.Modf(real)
+		return time.Unix(int64(seconds), int64(fraction*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("%w - document field and filter value are mismatched", ErrTypeMismatch)
+}
+
+func compareTime(doc_value time.Time, operator string, compare_value time.Time) bool {
+	switch operator {
+	case "==":
+		return doc_value.Equal(compare_value)
+	case "!=":
+		return !doc_value.Equal(compare_value)
+	case "<=":
+		return !doc_value.After(compare_value)
+	case ">=":
+		return !doc_value.Before(compare_value)
+	case "<":
+		return doc_value.Before(compare_value)
+	case ">":
+		return doc_value.After(compare_value)
+	}
+	return false
+}
+
 func compareFloat64(doc_value float64, operator string, compare_value float64) bool {
 	switch operator {
 	case "==":
@@ -1,9 +1,23 @@
 package opendivdb
 
 import (
+	"context"
+	"crypto/aes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -39,6 +53,7 @@ func Test_CRUD(t *testing.T) {
 	if err != nil {
 		t.Fatal("unable to create DB! " + err.Error())
 	}
+	defer DB.Close(context.Background())
 
 	err = ClearTestDatabase(DB)
 	if err != nil {
@@ -132,7 +147,7 @@ func Test_Encryption(t *testing.T) {
 	}
 
 	// Check to see if file exists
-	record := filepath.Join(config.Path, "test", doc_created.ID)
+	record := filepath.Join(config.Path, "Test", doc_created.ID)
 	if _, err := stat(record); err != nil {
 		t.Fatal("document '" + doc_created.ID + "' doesn't exist in 'test'")
 	}
@@ -153,6 +168,11 @@ func Test_Encryption(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
+	err = DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
 	t.Log("testing encrypted database")
 	config, err = LoadConfig("db_config.yml")
 	if err != nil {
@@ -164,6 +184,7 @@ func Test_Encryption(t *testing.T) {
 	if err != nil {
 		t.Fatal("unable to create DB! " + err.Error())
 	}
+	defer DB.Close(context.Background())
 	err = ClearTestDatabase(DB)
 	if err != nil {
 		t.Fatal(err.Error())
@@ -175,7 +196,7 @@ func Test_Encryption(t *testing.T) {
 	}
 
 	// Check to see if file exists
-	record = filepath.Join(config.Path, "test", doc_created.ID)
+	record = filepath.Join(config.Path, "Test", doc_created.ID)
 	if _, err := stat(record); err != nil {
 		t.Fatal("document '" + doc_created.ID + "' doesn't exist in 'test'")
 	}
@@ -197,6 +218,39 @@ func Test_Encryption(t *testing.T) {
 		t.Fatal("unable to un-marshall document: " + err.Error())
 	}
 
+	t.Log("testing encrypted document larger than 1MB")
+	large := TestObject{String: strings.Repeat("large document ", 100000), Number: 2}
+	doc_created, err = DB.Collection("Test").Add(large)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	doc, err = DB.Collection("Test").Document(doc_created.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	large_got := TestObject{}
+	err = doc.DataTo(&large_got)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if large_got != large {
+		t.Fatal("large document doesn't match the written object")
+	}
+	// Reopening the database decrypts every document
+	err = DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to reopen DB with a large document " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
 	err = ClearTestDatabase(DB)
 	if err != nil {
 		t.Fatal(err.Error())
@@ -216,6 +270,7 @@ func Test_Filter(t *testing.T) {
 	if err != nil {
 		t.Fatal("unable to create DB " + err.Error())
 	}
+	defer DB.Close(context.Background())
 
 	err = ClearTestDatabase(DB)
 	if err != nil {
@@ -423,6 +478,7 @@ func Test_Cache(t *testing.T) {
 	if err != nil {
 		t.Fatal("unable to create DB " + err.Error())
 	}
+	defer DB.Close(context.Background())
 
 	err = ClearTestDatabase(DB)
 	if err != nil {
@@ -505,7 +561,7 @@ func Test_Cache(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
-	if len(DB.cache.documents) != int(DB.cache.limit) {
+	if DB.CacheStats().Documents != config.Cache_limit {
 		t.Fatal("returned number of cached documents was unexpected")
 	}
 
@@ -517,7 +573,7 @@ func Test_Cache(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
-	if len(DB.cache.documents) != int(DB.cache.limit) {
+	if DB.CacheStats().Documents != config.Cache_limit {
 		t.Fatal("returned number of cached documents was unexpected")
 	}
 
@@ -543,6 +599,7 @@ func Test_Subscriptions(t *testing.T) {
 	if err != nil {
 		t.Fatal("unable to create DB " + err.Error())
 	}
+	defer DB.Close(context.Background())
 	// Cache not needed right now for this test
 
 	err = ClearTestDatabase(DB)
@@ -654,3 +711,2542 @@ func Test_Subscriptions(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 }
+
+func Test_Subscription_Policies(t *testing.T) {
+	var DB *Driver
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Create database driver
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing coalesce policy")
+	coalesce_sub, err := DB.Collection("Test").SubscribeWithOptions(SubscriptionOptions{Buffer: 1, Policy: Subscription_coalesce})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	disconnect_sub, err := DB.Collection("Test").SubscribeWithOptions(SubscriptionOptions{Buffer: 1, Policy: Subscription_disconnect})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Create documents without reading the subscriptions
+	for i := range 3 {
+		_, err = DB.Collection("Test").Add(TestObject{String: "test", Number: float64(i)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// Only the latest snapshot should be kept
+	snap := coalesce_sub.Next()
+	if snap.Error != nil {
+		t.Fatal(snap.Error.Error())
+	}
+	if len(snap.Data) != 3 {
+		t.Fatal("coalesced snapshot doesn't contain the latest state")
+	}
+	coalesce_sub.Unsubscribe()
+
+	t.Log("testing disconnect policy")
+	snap = disconnect_sub.Next()
+	if snap.Error == nil || snap.Error.Error() != "subscription has been disconnected, consumer is too slow" {
+		t.Fatal("slow subscription wasn't disconnected")
+	}
+
+	t.Log("testing drop oldest policy")
+	// Pushed directly without a push loop so the buffer fills up in a known order
+	drop_sub := &Subscription{
+		driver:     DB,
+		collection: DB.Collection("Test"),
+		channel:    make(chan Snapshot, 2),
+		done:       make(chan struct{}),
+		policy:     Subscription_drop_oldest,
+	}
+	for i := range 3 {
+		_, err = DB.Collection("Test").Add(TestObject{String: "drop", Number: float64(i)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		drop_sub.push()
+	}
+	// The snapshot of the first document was dropped, 3 documents were added by the coalesce test
+	for _, expected := range []int{5, 6} {
+		snap := drop_sub.Next()
+		if snap.Error != nil {
+			t.Fatal(snap.Error.Error())
+		}
+		if len(snap.Data) != expected {
+			t.Fatalf("snapshot holds %d documents, expected %d", len(snap.Data), expected)
+		}
+	}
+	drop_sub.mutex.Lock()
+	drop_sub.close(nil)
+	drop_sub.mutex.Unlock()
+
+	t.Log("testing full buffers with a concurrent subscriber")
+	for _, policy := range []string{Subscription_coalesce, Subscription_drop_oldest} {
+		sub, err := DB.Collection("Test").SubscribeWithOptions(SubscriptionOptions{Buffer: 1, Policy: policy})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		read := make(chan struct{})
+		go func() {
+			defer close(read)
+			for snap := sub.Next(); snap.Error == nil; snap = sub.Next() {
+			}
+		}()
+		pushed := make(chan struct{})
+		go func() {
+			defer close(pushed)
+			for range 1000 {
+				sub.push()
+			}
+			sub.Unsubscribe()
+		}()
+		select {
+		case <-pushed:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s push is blocked by the subscriber", policy)
+		}
+		<-read
+	}
+
+	t.Log("testing invalid policy")
+	_, err = DB.Collection("Test").SubscribeWithOptions(SubscriptionOptions{Policy: "BLOCK"})
+	if err == nil {
+		t.Fatal("unsupported policy was accepted")
+	}
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_Cache_Eviction(t *testing.T) {
+	doc_a := Document{ID: "a", Collection: "Test", Data: []byte(`{"String":"a"}`)}
+	doc_b := Document{ID: "b", Collection: "Test", Data: []byte(`{"String":"b"}`)}
+	doc_c := Document{ID: "c", Collection: "Test", Data: []byte(`{"String":"c"}`)}
+
+	t.Log("testing LRU eviction")
+	lru := newCache(time.Minute, nil, 2, 0, Cache_lru)
+	lru.add("Test", doc_a)
+	lru.add("Test", doc_b)
+	lru.getDoc("Test", "a")
+	lru.add("Test", doc_c)
+	if _, ok := lru.getDoc("Test", "b"); ok {
+		t.Fatal("least recently used document wasn't evicted")
+	}
+	if _, ok := lru.getDoc("Test", "a"); !ok {
+		t.Fatal("recently used document was evicted")
+	}
+
+	t.Log("testing LFU eviction")
+	lfu := newCache(time.Minute, nil, 2, 0, Cache_lfu)
+	lfu.add("Test", doc_a)
+	lfu.getDoc("Test", "a")
+	lfu.getDoc("Test", "a")
+	lfu.add("Test", doc_b)
+	lfu.add("Test", doc_c)
+	if _, ok := lfu.getDoc("Test", "b"); ok {
+		t.Fatal("least frequently used document wasn't evicted")
+	}
+	if _, ok := lfu.getDoc("Test", "a"); !ok {
+		t.Fatal("frequently used document was evicted")
+	}
+
+	t.Log("testing byte limit")
+	limited := newCache(time.Minute, nil, 100, docSize(doc_a)*2, Cache_lru)
+	limited.add("Test", doc_a)
+	limited.add("Test", doc_b)
+	limited.add("Test", doc_c)
+	if len(limited.documents) != 2 || limited.bytes > limited.max_bytes {
+		t.Fatal("cache exceeded byte limit")
+	}
+	if _, ok := limited.getDoc("Test", "a"); ok {
+		t.Fatal("oldest document wasn't evicted when byte limit was reached")
+	}
+
+	t.Log("testing replacing a cached document")
+	limited.add("Test", doc_c)
+	if len(limited.documents) != 2 || limited.bytes != docSize(doc_b)+docSize(doc_c) {
+		t.Fatal("replaced document was counted twice")
+	}
+}
+
+func Test_Cache_Stats(t *testing.T) {
+	var DB *Driver
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Cache_limit = 2
+
+	// Create database driver
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing hits and misses")
+	test1_doc, err := DB.Collection("Test").Add(TestObject{String: "test1", Number: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = DB.Collection("Test").Document(test1_doc.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = DB.Collection("Test").Document(test1_doc.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stats := DB.CacheStats().Collections["Test"]
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Documents != 1 {
+		t.Fatal("unexpected cache statistics for collection")
+	}
+
+	t.Log("testing pinned collection")
+	err = DB.PinCollection("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := range 3 {
+		_, err = DB.Collection("Test").Add(TestObject{String: "test", Number: float64(i)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	all_stats := DB.CacheStats()
+	if all_stats.Documents != 4 || all_stats.Evictions_limit != 0 || !all_stats.Collections["Test"].Pinned {
+		t.Fatal("pinned documents were evicted")
+	}
+
+	t.Log("testing unpinning collection")
+	err = DB.UnpinCollection("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	all_stats = DB.CacheStats()
+	if all_stats.Documents != 2 || all_stats.Evictions_limit != 2 {
+		t.Fatal("documents over the limit weren't evicted after unpinning")
+	}
+
+	t.Log("testing warming collection")
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DB.PinCollection("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DB.WarmCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if DB.CacheStats().Collections["Test"].Documents != 4 {
+		t.Fatal("collection wasn't loaded into the cache")
+	}
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_Query_Cache(t *testing.T) {
+	var DB *Driver
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Create database driver
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := range 2 {
+		_, err = DB.Collection("Test").Add(TestObject{String: "test", Number: float64(i + 1)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	t.Log("testing repeated query is answered from cache")
+	col, err := DB.Collection("Test").Where("Number", ">", 0).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 2 {
+		t.Fatal("returned number of documents are not what is expected")
+	}
+	hits := DB.CacheStats().Query_hits
+	col, err = DB.Collection("Test").Where("Number", ">", 0).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 2 || DB.CacheStats().Query_hits != hits+1 {
+		t.Fatal("query wasn't answered from cache")
+	}
+
+	t.Log("testing unrelated write keeps cached query")
+	_, err = DB.Collection("Test").Add(TestObject{String: "test", Number: -1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = DB.Collection("Test").Where("Number", ">", 0).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if DB.CacheStats().Query_hits != hits+2 {
+		t.Fatal("write outside of the filter invalidated the cached query")
+	}
+
+	t.Log("testing matching write invalidates cached query")
+	doc, err := DB.Collection("Test").Add(TestObject{String: "test", Number: 3})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	col, err = DB.Collection("Test").Where("Number", ">", 0).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 3 {
+		t.Fatal("cached query wasn't invalidated by a matching write")
+	}
+
+	t.Log("testing delete invalidates cached query")
+	err = DB.Collection("Test").Delete(doc.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	col, err = DB.Collection("Test").Where("Number", ">", 0).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 2 {
+		t.Fatal("cached query wasn't invalidated by a delete")
+	}
+
+	t.Log("testing values with spaces don't share a cached query")
+	for id, value := range map[string]string{"x": "a b", "y": "b c"} {
+		_, err = DB.Collection("Test").Write(id, TestObject{String: value})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	in_tests := []struct {
+		values   []string
+		expected string
+	}{
+		{[]string{"a b", "c"}, "x"},
+		{[]string{"a", "b c"}, "y"},
+	}
+	for _, test := range in_tests {
+		ids, err := DB.Collection("Test").Where("String", "in", test.values).IDs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.Join(ids, ",") != test.expected {
+			t.Fatalf("query for %q returned %v", test.values, ids)
+		}
+	}
+	group, err := ParseQuery(`String == "x" AND Number == 1`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	condition := newFilter("(String", "==", "x) AND Number == float64(1")
+	if group.key() == condition.key() {
+		t.Fatal("a condition has the same cache key as a group of conditions")
+	}
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_Cache_Expiry(t *testing.T) {
+	doc_a := Document{ID: "a", Collection: "Test", Data: []byte(`{"String":"a"}`)}
+	doc_b := Document{ID: "b", Collection: "Fast", Data: []byte(`{"String":"b"}`)}
+
+	c := newCache(time.Minute, map[string]time.Duration{"Fast": time.Millisecond * 500}, 10, 0, Cache_lru)
+	go c.runCachePurge()
+	defer c.stop()
+
+	t.Log("testing collection timeout override")
+	c.add("Test", doc_a)
+	c.add("Fast", doc_b)
+	time.Sleep(time.Second)
+	if _, ok := c.getDoc("Fast", "b"); ok {
+		t.Fatal("document wasn't purged after the collection's timeout")
+	}
+	if _, ok := c.getDoc("Test", "a"); !ok {
+		t.Fatal("document was purged before the default timeout")
+	}
+	if c.stats().Evictions_timeout != 1 {
+		t.Fatal("timeout eviction wasn't counted")
+	}
+
+	t.Log("testing reads extend expiry")
+	c.add("Fast", doc_b)
+	for range 3 {
+		time.Sleep(time.Millisecond * 300)
+		if _, ok := c.getDoc("Fast", "b"); !ok {
+			t.Fatal("document was purged while it was being read")
+		}
+	}
+}
+
+func Test_Close(t *testing.T) {
+	var DB *Driver
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Create database driver
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	doc, err := DB.Collection("Test").Add(TestObject{String: "test1", Number: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sub, err := DB.Collection("Test").Subscribe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing closing the driver")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = DB.Close(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing closed driver returns ErrClosed")
+	_, err = DB.Collection("Test").Add(TestObject{String: "test2", Number: 2})
+	if !errors.Is(err, ErrClosed) {
+		t.Fatal("write on closed driver didn't return ErrClosed")
+	}
+	_, err = DB.Collection("Test").Document(doc.ID)
+	if !errors.Is(err, ErrClosed) {
+		t.Fatal("read on closed driver didn't return ErrClosed")
+	}
+	_, err = DB.Collection("Test").Subscribe()
+	if !errors.Is(err, ErrClosed) {
+		t.Fatal("subscribe on closed driver didn't return ErrClosed")
+	}
+	if err = DB.Close(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatal("closing a closed driver didn't return ErrClosed")
+	}
+
+	t.Log("testing subscriptions are closed")
+	snap := sub.Next()
+	if !errors.Is(snap.Error, ErrClosed) {
+		t.Fatal("subscription wasn't closed with the driver")
+	}
+
+	err = os.RemoveAll(filepath.Join(config.Path, "Test"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_Lock(t *testing.T) {
+	var DB *Driver
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Create database driver
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	doc, err := DB.Collection("Test").Add(TestObject{String: "test1", Number: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing second writer is refused")
+	_, err = NewDB(config)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatal("database was opened twice for writing")
+	}
+
+	t.Log("testing read-only driver next to the writer")
+	read_only_config := config
+	read_only_config.Read_only = true
+	read_only_DB, err := NewDB(read_only_config)
+	if err != nil {
+		t.Fatal("unable to create read-only DB " + err.Error())
+	}
+	got, err := read_only_DB.Collection("Test").Document(doc.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Hash != doc.Hash {
+		t.Fatal("read-only driver returned a different document")
+	}
+	_, err = read_only_DB.Collection("Test").Add(TestObject{String: "test2", Number: 2})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatal("read-only driver accepted a write")
+	}
+	err = read_only_DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing lock is released on close")
+	err = DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to reopen DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_Temp_File_Recovery(t *testing.T) {
+	var DB *Driver
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Durability = Durability_full
+
+	// Create database driver
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = DB.Collection("Test").Add(TestObject{String: "test1", Number: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Leave behind temporary files as if writes were interrupted
+	dir := filepath.Join(config.Path, "Test")
+	interrupted := Document{ID: "interrupted", Collection: "Test", Updated_at: time.Now(), Data: []byte(`{"String":"test2","Number":2}`)}
+	b, err := DB.encodeDocument(interrupted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = os.WriteFile(filepath.Join(dir, "interrupted"+tmp_suffix), b, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = os.WriteFile(filepath.Join(dir, "partial"+tmp_suffix), b[:len(b)/2], 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing temporary files aren't listed as documents")
+	col, err := DB.Collection("Test").Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 1 {
+		t.Fatal("temporary files were listed as documents")
+	}
+
+	t.Log("testing temporary files are recovered on open")
+	err = DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to reopen DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
+	if _, err := os.Stat(filepath.Join(dir, "partial"+tmp_suffix)); !os.IsNotExist(err) {
+		t.Fatal("incomplete temporary file wasn't removed")
+	}
+	doc, err := DB.Collection("Test").Document("interrupted")
+	if err != nil {
+		t.Fatal("complete temporary file wasn't recovered " + err.Error())
+	}
+	if doc.ID != interrupted.ID {
+		t.Fatal("recovered document doesn't match")
+	}
+
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_Storage_Backends(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+
+	for _, storage := range []string{Storage_memory, Storage_file} {
+		t.Log("testing " + storage + " storage")
+		config.Storage = storage
+		DB, err := NewDB(config)
+		if err != nil {
+			t.Fatal("unable to create DB " + err.Error())
+		}
+
+		test1 := TestObject{String: "test1", Number: 1}
+		doc1, err := DB.Collection("Test").Add(test1)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		doc2, err := DB.Collection("Test").Add(TestObject{String: "test2", Number: 2})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = DB.Collection("Test").Write(doc2.ID, TestObject{String: "test2_updated", Number: 3})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = DB.Collection("Test").Delete(doc1.ID)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		col, err := DB.Collection("Test").Where("Number", "==", 3).Documents()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(col) != 1 || col[0].ID != doc2.ID {
+			t.Fatal("returned documents are not what is expected")
+		}
+		_, err = DB.Collection("Test").Document(doc1.ID)
+		if err == nil {
+			t.Fatal("deleted document still exists")
+		}
+
+		if storage == Storage_file {
+			t.Log("testing read-only driver lists collections created by the writer")
+			read_only_config := config
+			read_only_config.Read_only = true
+			read_only_DB, err := NewDB(read_only_config)
+			if err != nil {
+				t.Fatal("unable to create read-only DB " + err.Error())
+			}
+			_, err = DB.Collection("Other").Write("other", TestObject{String: "other"})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			collections, err := read_only_DB.Collections()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !slices.Contains(collections, "Other") {
+				t.Fatalf("read-only driver listed collections %v", collections)
+			}
+			err = read_only_DB.Close(context.Background())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			err = DB.Collection("Other").Drop()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		err = DB.Close(context.Background())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if storage == Storage_memory {
+			continue
+		}
+
+		t.Log("testing file storage is rebuilt on open")
+		// Simulate a write cut short by a crash
+		log_path := filepath.Join(config.Path, file_storage_name)
+		f, err := os.OpenFile(log_path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = f.Write(encodeRecord(record_write, "Test", "partial", []byte("partial"))[:12])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		f.Close()
+
+		DB, err = NewDB(config)
+		if err != nil {
+			t.Fatal("unable to reopen DB " + err.Error())
+		}
+		col, err = DB.Collection("Test").Documents()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(col) != 1 || col[0].ID != doc2.ID {
+			t.Fatal("file storage wasn't rebuilt correctly")
+		}
+		got := TestObject{}
+		err = col[0].DataTo(&got)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if got.String != "test2_updated" {
+			t.Fatal("file storage returned an old version of the document")
+		}
+
+		err = DB.Close(context.Background())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		t.Log("testing corrupt record in the middle of the file storage")
+		b, err := os.ReadFile(log_path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		// Flip the last byte of the first record's document
+		first_size := record_header_size + int(binary.BigEndian.Uint32(b))
+		b[first_size-1] ^= 0xff
+		err = os.WriteFile(log_path, b, 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = NewDB(config)
+		if err == nil {
+			t.Fatal("file storage with a corrupt record was opened")
+		}
+		fi, err := os.Stat(log_path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fi.Size() != int64(len(b)) {
+			t.Fatal("records after a corrupt record were removed")
+		}
+
+		t.Log("testing corrupt record length in the middle of the file storage")
+		// Restore the document and make the first record's length run past the end of the file
+		b[first_size-1] ^= 0xff
+		b[0] ^= 0x01
+		err = os.WriteFile(log_path, b, 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = NewDB(config)
+		if err == nil {
+			t.Fatal("file storage with a corrupt record length was opened")
+		}
+		fi, err = os.Stat(log_path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fi.Size() != int64(len(b)) {
+			t.Fatal("records after a corrupt record length were removed")
+		}
+		err = os.Remove(log_path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func Test_Log_Storage(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	config.Storage = Storage_log
+	config.Log_segment_size = 1024
+	defer os.RemoveAll(filepath.Join(config.Path, log_storage_dir))
+
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+
+	t.Log("testing segments are rolled")
+	ids := []string{}
+	for i := range 10 {
+		doc, err := DB.Collection("Test").Add(TestObject{String: "test", Number: float64(i)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, doc.ID)
+	}
+	for round := range 5 {
+		for i, id := range ids {
+			_, err := DB.Collection("Test").Write(id, TestObject{String: "updated", Number: float64(i + round*100)})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+	for _, id := range ids[5:] {
+		err := DB.Collection("Test").Delete(id)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	storage := DB.storage.(*log_storage)
+	if len(storage.segments) < 3 {
+		t.Fatal("expected several segments to be written")
+	}
+
+	t.Log("testing compaction")
+	err = storage.compact(true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(storage.segments) != 2 {
+		t.Fatalf("expected a merged and an active segment after compaction, got %d segments", len(storage.segments))
+	}
+	checkDocuments := func(DB *Driver) {
+		col, err := DB.Collection("Test").Documents()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(col) != 5 {
+			t.Fatalf("expected 5 documents, got %d", len(col))
+		}
+		for _, doc := range col {
+			got := TestObject{}
+			err = doc.DataTo(&got)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if got.String != "updated" || got.Number < 400 {
+				t.Fatal("storage returned an old version of the document")
+			}
+		}
+	}
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	checkDocuments(DB)
+
+	err = DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing log storage is rebuilt on open")
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to reopen DB " + err.Error())
+	}
+	checkDocuments(DB)
+	_, err = DB.Collection("Test").Document(ids[9])
+	if err == nil {
+		t.Fatal("deleted document still exists")
+	}
+
+	t.Log("testing read-only driver lists collections created by the writer")
+	read_only_config := config
+	read_only_config.Read_only = true
+	read_only_DB, err := NewDB(read_only_config)
+	if err != nil {
+		t.Fatal("unable to create read-only DB " + err.Error())
+	}
+	_, err = DB.Collection("Other").Write("other", TestObject{String: "other"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	collections, err := read_only_DB.Collections()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !slices.Contains(collections, "Other") {
+		t.Fatalf("read-only driver listed collections %v", collections)
+	}
+	err = read_only_DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing corrupt record length in the active segment")
+	// Start a new segment so it only holds the records written here
+	storage = DB.storage.(*log_storage)
+	storage.mutex.Lock()
+	err = storage.roll()
+	storage.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	active := storage.active.id
+	for i := range 2 {
+		_, err := DB.Collection("Test").Add(TestObject{String: "tail", Number: float64(i)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if storage.active.id != active {
+		t.Fatal("expected the records to be written to the same segment")
+	}
+	segment_path := filepath.Join(storage.dir, segmentName(active))
+	err = DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := os.ReadFile(segment_path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Make the first record's length run past the end of the segment
+	b[0] ^= 0x01
+	err = os.WriteFile(segment_path, b, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = NewDB(config)
+	if err == nil {
+		t.Fatal("log storage with a corrupt record length was opened")
+	}
+	fi, err := os.Stat(segment_path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Size() != int64(len(b)) {
+		t.Fatal("records after a corrupt record length were removed")
+	}
+}
+
+func Test_Subcollections(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	t.Log("testing subcollection write and query")
+	user, err := DB.Collection("Test").Add(TestObject{String: "user", Number: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	orders := DB.Collection("Test").Doc(user.ID).Collection("orders")
+	sub, err := orders.Subscribe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sub.Unsubscribe()
+	order, err := orders.Add(TestObject{String: "order", Number: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if order.Collection != "Test/"+user.ID+"/orders" {
+		t.Fatal("document collection is not the subcollection path")
+	}
+	items := orders.Doc(order.ID).Collection("items")
+	_, err = items.Add(TestObject{String: "item", Number: 3})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	col, err := DB.Collection("Test/"+user.ID+"/orders").Where("Number", "==", 2).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 1 || col[0].ID != order.ID {
+		t.Fatal("subcollection query didn't return the expected document")
+	}
+	col, err = DB.Collection("Test").Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 1 || col[0].ID != user.ID {
+		t.Fatal("collection query returned documents of a subcollection")
+	}
+	snapshot := sub.Next()
+	if snapshot.Error != nil {
+		t.Fatal(snapshot.Error.Error())
+	}
+	if len(snapshot.Data) != 1 || snapshot.Data[0].ID != order.ID {
+		t.Fatal("subscription didn't receive the subcollection document")
+	}
+
+	_, err = DB.Collection("Test").Write(user.ID+"/orders", TestObject{})
+	if err == nil {
+		t.Fatal("document ID with '/' was accepted")
+	}
+	_, err = DB.Collection("Test/" + user.ID).Documents()
+	if err == nil {
+		t.Fatal("document path was accepted as a collection")
+	}
+
+	t.Log("testing subcollections are listed from the directory of their parent")
+	listed := map[string]string{
+		"Test":                         "Test/" + user.ID + "/orders,Test/" + user.ID + "/orders/" + order.ID + "/items",
+		"Test/" + user.ID:              "Test/" + user.ID + "/orders,Test/" + user.ID + "/orders/" + order.ID + "/items",
+		"Test/" + user.ID + "/orders":  "Test/" + user.ID + "/orders/" + order.ID + "/items",
+		"Test/" + user.ID + "/missing": "",
+	}
+	for path, expected := range listed {
+		subcollections, err := DB.storage.(*directory_storage).Subcollections(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sort.Strings(subcollections)
+		if strings.Join(subcollections, ",") != expected {
+			t.Fatalf("subcollections of '%s' are %v", path, subcollections)
+		}
+	}
+
+	t.Log("testing recursive delete")
+	err = DB.Collection("Test").Delete(user.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	col, err = items.Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 0 {
+		t.Fatal("documents of a nested subcollection were not deleted")
+	}
+	_, err = orders.Document(order.ID)
+	if err == nil {
+		t.Fatal("subcollection document still exists")
+	}
+	if _, err := os.Stat(filepath.Join(config.Path, "Test", user.ID+subcollections_suffix)); !os.IsNotExist(err) {
+		t.Fatal("subcollections directory was not removed")
+	}
+}
+
+func Test_Collection_Management(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer DB.Collection("Test_renamed").Drop()
+
+	doc1, err := DB.Collection("Test").Add(TestObject{String: "test1", Number: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	doc2, err := DB.Collection("Test").Add(TestObject{String: "test2", Number: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = DB.Collection("Test").Doc(doc1.ID).Collection("sub").Add(TestObject{String: "sub", Number: 3})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing collection list")
+	collections, err := DB.Collections()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	found := map[string]bool{}
+	for _, name := range collections {
+		found[name] = true
+	}
+	if !found["Test"] || !found["Test/"+doc1.ID+"/sub"] {
+		t.Fatal("collection list is missing collections")
+	}
+
+	t.Log("testing collection stats")
+	stats, err := DB.Collection("Test").Stats()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stats.Documents != 2 || stats.Bytes == 0 || !stats.Updated_at.Equal(doc2.Updated_at) {
+		t.Fatal("collection stats are not what is expected")
+	}
+
+	t.Log("testing collection stats don't read documents")
+	storage := &failing_storage{memory_storage: newMemoryStorage()}
+	memory_config := config
+	memory_config.Storage_backend = storage
+	memory_config.Read_only = true
+	memory_DB, err := NewDB(memory_config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer memory_DB.Close(context.Background())
+	for id, b := range map[string]string{"doc1": "12345", "doc2": "123"} {
+		err = storage.Write("Test", id, []byte(b))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	stats, err = memory_DB.Collection("Test").Stats()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stats.Documents != 2 || stats.Bytes != 8 || storage.reads.Load() != 0 {
+		t.Fatalf("collection stats %+v took %d reads", stats, storage.reads.Load())
+	}
+
+	t.Log("testing collection rename")
+	sub, err := DB.Collection("Test").Subscribe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sub.Next()
+	err = DB.Collection("Test").Rename("Test_renamed")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	col, err := DB.Collection("Test_renamed").Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 2 || col[0].Collection != "Test_renamed" {
+		t.Fatal("renamed collection doesn't hold the documents")
+	}
+	col, err = DB.Collection("Test_renamed").Doc(doc1.ID).Collection("sub").Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 1 {
+		t.Fatal("subcollection was not renamed")
+	}
+	col, err = DB.Collection("Test").Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 0 {
+		t.Fatal("documents were left in the old collection")
+	}
+	for snapshot := sub.Next(); snapshot.Error == nil; snapshot = sub.Next() {
+	}
+	if snapshot := sub.Next(); !errors.Is(snapshot.Error, ErrDropped) {
+		t.Fatal("subscription to the renamed collection was not closed")
+	}
+
+	t.Log("testing collection drop")
+	err = DB.Collection("Test_renamed").Drop()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	collections, err = DB.Collections()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range collections {
+		if strings.HasPrefix(name, "Test_renamed") {
+			t.Fatal("dropped collection '" + name + "' is still listed")
+		}
+	}
+	_, err = DB.Collection("Test_renamed").Document(doc2.ID)
+	if err == nil {
+		t.Fatal("document of a dropped collection still exists")
+	}
+}
+
+func Test_Replication(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	config.Storage = Storage_memory
+	config.Replication_pass = "replication-pass"
+	peer, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create peer DB " + err.Error())
+	}
+	defer peer.Close(context.Background())
+	server := httptest.NewServer(peer.server.Handler)
+	defer server.Close()
+
+	config.Replication_nodes = map[string]string{"peer": server.URL}
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	DB.mutex.Lock()
+	host := DB.replication_hosts["peer"]
+	host.state = "ONLINE"
+	DB.replication_hosts["peer"] = host
+	DB.mutex.Unlock()
+
+	_, err = peer.Collection("Test").Write("doc1", map[string]any{"Number": 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing unauthenticated requests are rejected")
+	statuses := map[string]int{"/api/sync/collection?collection=Test": http.StatusUnauthorized, "/collection?collection=Test": http.StatusNotFound}
+	for path, status := range statuses {
+		res := httptest.NewRecorder()
+		peer.server.Handler.ServeHTTP(res, httptest.NewRequest("DELETE", path, nil))
+		if res.Code != status {
+			t.Fatalf("unauthenticated drop on '%s' returned status %d", path, res.Code)
+		}
+	}
+	exists, err := peer.Collection("Test").Exists("doc1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !exists {
+		t.Fatal("unauthenticated request dropped the collection")
+	}
+
+	t.Log("testing writes and drops are replicated to the peer")
+	_, err = DB.Collection("Other").Write("doc2", map[string]any{"Number": 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DB.Collection("Test").Drop()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Close waits for the replication pushes
+	err = DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	exists, err = peer.Collection("Test").Exists("doc1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if exists {
+		t.Fatal("drop was not replicated to the peer")
+	}
+	exists, err = peer.Collection("Other").Exists("doc2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !exists {
+		t.Fatal("write was not replicated to the peer")
+	}
+}
+
+func Test_Count(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	count, err := DB.Collection("Test").Count()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 0 {
+		t.Fatal("collection that doesn't exist has documents")
+	}
+
+	var ids []string
+	for i := range 5 {
+		doc, err := DB.Collection("Test").Add(TestObject{String: "test", Number: float64(i)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, doc.ID)
+	}
+
+	t.Log("testing count")
+	count, err = DB.Collection("Test").Count()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 5 {
+		t.Fatalf("expected 5 documents, got %d", count)
+	}
+	count, err = DB.Collection("Test").Where("Number", ">=", 3).Count()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 filtered documents, got %d", count)
+	}
+
+	t.Log("testing IDs")
+	got, err := DB.Collection("Test").IDs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sort.Strings(ids)
+	if strings.Join(got, ",") != strings.Join(ids, ",") {
+		t.Fatal("returned IDs are not what is expected")
+	}
+
+	t.Log("testing count of a metadata filter doesn't read documents")
+	before := DB.CacheStats()
+	count, err = DB.Collection("Test").Where(Field_id, "in", ids[:2]).Count()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 documents matching the ID filter, got %d", count)
+	}
+	after := DB.CacheStats()
+	if after.Hits+after.Misses != before.Hits+before.Misses {
+		t.Fatalf("count of a metadata filter read %d documents", after.Hits+after.Misses-before.Hits-before.Misses)
+	}
+
+	t.Log("testing exists")
+	exists, err := DB.Collection("Test").Exists(ids[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !exists {
+		t.Fatal("existing document was not found")
+	}
+	err = DB.Collection("Test").Delete(ids[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	exists, err = DB.Collection("Test").Exists(ids[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if exists {
+		t.Fatal("deleted document still exists")
+	}
+}
+
+func Test_Aggregate(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	for i, test := range []TestObject{
+		{String: "a", Number: 1, Bool: true},
+		{String: "a", Number: 3, Bool: true},
+		{String: "b", Number: 10, Bool: true},
+		{String: "b", Number: 20, Bool: false},
+	} {
+		_, err := DB.Collection("Test").Write(fmt.Sprintf("doc%d", i), test)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	t.Log("testing aggregation without groups")
+	results, err := DB.Collection("Test").Aggregate().Count().Sum("Number").Avg("Number").Min("Number").Max("Number").Results()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if results[0].Count != 4 || results[0].Sum["Number"] != 34 || results[0].Avg["Number"] != 8.5 || results[0].Min["Number"] != 1 || results[0].Max["Number"] != 20 {
+		t.Fatal("aggregation result is not what is expected")
+	}
+
+	t.Log("testing aggregation with groups and filter")
+	results, err = DB.Collection("Test").Where("Bool", "==", true).Aggregate().GroupBy("String").Sum("Number").Count().Results()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(results))
+	}
+	if results[0].Group["String"] != "a" || results[0].Count != 2 || results[0].Sum["Number"] != 4 {
+		t.Fatal("first group is not what is expected")
+	}
+	if results[1].Group["String"] != "b" || results[1].Count != 1 || results[1].Sum["Number"] != 10 {
+		t.Fatal("second group is not what is expected")
+	}
+
+	_, err = DB.Collection("Test").Aggregate().Sum("String").Results()
+	if err == nil {
+		t.Fatal("sum of a string field didn't return an error")
+	}
+}
+
+func Test_Select(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	doc, err := DB.Collection("Test").Add(map[string]any{
+		"Name":    "test1",
+		"Number":  1,
+		"Address": map[string]any{"City": "Budapest", "Zip": "1011"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing field selection")
+	col, err := DB.Collection("Test").Where("Number", "==", 1).Select("Name", "Address.City", "Missing").Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 1 {
+		t.Fatal("returned documents are not what is expected")
+	}
+	got := map[string]any{}
+	err = col[0].DataTo(&got)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(got) != 2 || got["Name"] != "test1" {
+		t.Fatal("selected fields are not what is expected")
+	}
+	address, ok := got["Address"].(map[string]any)
+	if !ok || len(address) != 1 || address["City"] != "Budapest" {
+		t.Fatal("selected nested field is not what is expected")
+	}
+
+	t.Log("testing cached documents keep every field")
+	doc, err = DB.Collection("Test").Document(doc.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got = map[string]any{}
+	err = doc.DataTo(&got)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(got) != 3 {
+		t.Fatal("selecting fields changed the cached document")
+	}
+}
+
+func Test_Filter_Operators(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	docs := map[string]map[string]any{
+		"doc1": {"Name": "Apple pie", "Number": 1, "Tags": []string{"sweet", "baked"}, "Made": "2024-05-01"},
+		"doc2": {"Name": "apple juice", "Number": 2, "Tags": []string{"drink"}, "Made": 1714608000},
+		"doc3": {"Name": "Banana", "Number": 3, "Optional": true, "Made": "2024-05-03T00:00:00Z"},
+	}
+	for id, data := range docs {
+		_, err := DB.Collection("Test").Write(id, data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tests := []struct {
+		field    string
+		operator string
+		value    any
+		expected string
+	}{
+		{"Number", "in", []int{1, 3}, "doc1,doc3"},
+		{"Number", "not-in", []float64{1, 3}, "doc2"},
+		{"Number", "<", uint(2), "doc1"},
+		{"Number", "==", uint8(3), "doc3"},
+		{"Name", "in", []string{"Banana"}, "doc3"},
+		{"Made", "in", []time.Time{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)}, "doc1,doc2"},
+		{"Made", "not-in", []time.Time{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}, "doc2,doc3"},
+		{"Tags", "array-contains", "drink", "doc2"},
+		{"Tags", "array-contains-any", []string{"baked", "drink"}, "doc1,doc2"},
+		{"Name", "prefix", "Apple", "doc1"},
+		{"Name", "prefix-i", "APPLE", "doc1,doc2"},
+		{"Name", "contains", "an", "doc3"},
+		{"Name", "contains-i", "JUICE", "doc2"},
+		{"Name", "regex", "^[A-Z]", "doc1,doc3"},
+		{"Name", "regex-i", "^apple (pie|juice)$", "doc1,doc2"},
+		{"Optional", "exists", nil, "doc3"},
+		{"Optional", "not-exists", nil, "doc1,doc2"},
+	}
+	for _, test := range tests {
+		t.Log("testing " + test.operator + " filter")
+		ids, err := DB.Collection("Test").Where(test.field, test.operator, test.value).IDs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.Join(ids, ",") != test.expected {
+			t.Fatalf("%s %s %v returned %v, expected %s", test.field, test.operator, test.value, ids, test.expected)
+		}
+	}
+
+	_, err = DB.Collection("Test").Where("Name", "regex", "(").Documents()
+	if err == nil {
+		t.Fatal("invalid regex didn't return an error")
+	}
+	_, err = DB.Collection("Test").Where("Number", "in", 1).Documents()
+	if err == nil {
+		t.Fatal("in filter with a value that isn't a slice didn't return an error")
+	}
+
+	t.Log("testing query times in the formats of time filters")
+	ids, err := DB.Collection("Test").WhereQuery(`Made in [time("2024-05-01"), time("2024-05-03 00:00:00")]`).IDs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(ids, ",") != "doc1,doc3" {
+		t.Fatalf("query with times returned %v", ids)
+	}
+}
+
+func Test_Time_Filter(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	docs := map[string]map[string]any{
+		"doc1": {"Time": base.Format(time.RFC3339Nano)},
+		"doc2": {"Time": base.Add(time.Hour).Format("2006-01-02T15:04:05")},
+		"doc3": {"Time": base.Add(2 * time.Hour).Unix()},
+	}
+	for _, id := range []string{"doc1", "doc2", "doc3"} {
+		_, err := DB.Collection("Test").Write(id, docs[id])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tests := []struct {
+		operator string
+		value    time.Time
+		expected string
+	}{
+		{"==", base.Add(time.Hour), "doc2"},
+		{"!=", base.Add(time.Hour), "doc1,doc3"},
+		{"<=", base.Add(time.Hour), "doc1,doc2"},
+		{">=", base.Add(time.Hour), "doc2,doc3"},
+		{"<", base.Add(time.Hour), "doc1"},
+		{">", base.Add(time.Hour), "doc3"},
+	}
+	for _, test := range tests {
+		t.Log("testing time " + test.operator + " filter")
+		ids, err := DB.Collection("Test").Where("Time", test.operator, test.value).IDs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.Join(ids, ",") != test.expected {
+			t.Fatalf("Time %s %v returned %v, expected %s", test.operator, test.value, ids, test.expected)
+		}
+	}
+
+	t.Log("testing update time filter")
+	before_update := time.Now()
+	time.Sleep(time.Millisecond * 10)
+	_, err = DB.Collection("Test").Write("doc1", docs["doc1"])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ids, err := DB.Collection("Test").Where(Field_updated_at, ">", before_update).IDs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(ids, ",") != "doc1" {
+		t.Fatalf("update time filter returned %v", ids)
+	}
+}
+
+func Test_Metadata_Fields(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	for _, id := range []string{"user-2", "user-1", "admin-1"} {
+		_, err := DB.Collection("Test").Write(id, TestObject{String: id, Number: float64(len(id))})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	t.Log("testing ID filter")
+	ids, err := DB.Collection("Test").Where(Field_id, "prefix", "user-").IDs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(ids, ",") != "user-1,user-2" {
+		t.Fatalf("ID filter returned %v", ids)
+	}
+
+	t.Log("testing hash filter")
+	doc, err := DB.Collection("Test").Document("user-1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ids, err = DB.Collection("Test").Where(Field_hash, "==", doc.Hash).IDs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(ids, ",") != "user-1" {
+		t.Fatalf("hash filter returned %v", ids)
+	}
+
+	t.Log("testing order by update time")
+	col, err := DB.Collection("Test").OrderBy(Field_updated_at, Order_desc).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 3 || col[0].ID != "admin-1" || col[1].ID != "user-1" || col[2].ID != "user-2" {
+		t.Fatal("documents are not ordered by update time")
+	}
+	// Formatted update times with fewer fraction digits or another time zone don't sort as strings
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	unsorted := []Document{
+		{ID: "doc1", Updated_at: base.Add(120 * time.Millisecond), Data: json.RawMessage("{}")},
+		{ID: "doc2", Updated_at: base.Add(100 * time.Millisecond), Data: json.RawMessage("{}")},
+		{ID: "doc3", Updated_at: base, Data: json.RawMessage("{}")},
+		{ID: "doc4", Updated_at: base.Add(-time.Minute).In(time.FixedZone("UTC+2", 2*60*60)), Data: json.RawMessage("{}")},
+	}
+	sorted, err := sortDocuments(unsorted, []order_by{{field: Field_updated_at, direction: Order_asc}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sorted_ids := []string{}
+	for _, doc := range sorted {
+		sorted_ids = append(sorted_ids, doc.ID)
+	}
+	if strings.Join(sorted_ids, ",") != "doc4,doc3,doc2,doc1" {
+		t.Fatalf("sub-second update times are ordered %v", sorted_ids)
+	}
+
+	t.Log("testing order by data field")
+	col, err = DB.Collection("Test").OrderBy("Number", Order_asc).OrderBy(Field_id, Order_desc).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 3 || col[0].ID != "user-2" || col[1].ID != "user-1" || col[2].ID != "admin-1" {
+		t.Fatal("documents are not ordered by number and ID")
+	}
+
+	_, err = DB.Collection("Test").OrderBy("Number", "sideways").Documents()
+	if err == nil {
+		t.Fatal("unsupported order direction didn't return an error")
+	}
+}
+
+func Test_Query_Language(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	docs := map[string]map[string]any{
+		"doc1": {"Status": "open", "Priority": 1, "Tags": []string{"urgent"}, "Time": "2024-05-01T12:00:00Z"},
+		"doc2": {"Status": "open", "Priority": 5, "Tags": []string{}, "Time": "2024-05-02T12:00:00Z"},
+		"doc3": {"Status": "closed", "Priority": 5, "Tags": []string{"urgent"}, "Time": "2024-05-03T12:00:00Z"},
+		"doc4": {"Status": "open", "Priority": 2, "Tags": []string{"later"}},
+	}
+	for id, data := range docs {
+		_, err := DB.Collection("Test").Write(id, data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`Status == "open" AND (Priority >= 3 OR Tags array-contains "urgent")`, "doc1,doc2"},
+		{`Status == "open" and Priority >= 3 or Tags array-contains "urgent"`, "doc1,doc2,doc3"},
+		{`Priority in [1, 2] AND Time not-exists`, "doc4"},
+		{`Time >= time("2024-05-02T00:00:00Z")`, "doc2,doc3"},
+		{`__id prefix "doc" AND Status != "open"`, "doc3"},
+		{`Status regex-i "^OPEN$" AND Priority < -1.5e1`, ""},
+	}
+	for _, test := range tests {
+		t.Log("testing query " + test.query)
+		ids, err := DB.Collection("Test").WhereQuery(test.query).IDs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.Join(ids, ",") != test.expected {
+			t.Fatalf("query returned %v, expected %s", ids, test.expected)
+		}
+	}
+
+	t.Log("testing parse errors")
+	errors_tests := []struct {
+		query    string
+		position int
+	}{
+		{`Status = "open"`, 7},
+		{`Status == "open`, 10},
+		{`(Status == "open"`, 17},
+		{`Status == "open" AND`, 20},
+		{`Priority in [1 2]`, 15},
+		{`Status like "open"`, 7},
+	}
+	for _, test := range errors_tests {
+		_, err := ParseQuery(test.query)
+		var query_err *QueryError
+		if !errors.As(err, &query_err) {
+			t.Fatalf("query '%s' didn't return a parse error", test.query)
+		}
+		if query_err.Position != test.position {
+			t.Fatalf("query '%s' returned error '%s', expected position %d", test.query, err.Error(), test.position)
+		}
+	}
+	_, err = DB.Collection("Test").WhereQuery(`Status ==`).Documents()
+	if err == nil {
+		t.Fatal("query that can't be parsed didn't return an error")
+	}
+
+	t.Log("testing parse errors after a cached unfiltered query")
+	_, err = DB.Collection("Test").Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	col, err := DB.Collection("Test").WhereQuery(`Status ==`).Documents()
+	if err == nil || len(col) != 0 {
+		t.Fatalf("query that can't be parsed returned %d cached documents", len(col))
+	}
+	_, err = DB.Collection("Test").WhereQuery(`Status ==`).Count()
+	if err == nil {
+		t.Fatal("count of a query that can't be parsed didn't return an error")
+	}
+	for _, err := range DB.Collection("Test").WhereQuery(`Status ==`).Iter(context.Background()) {
+		if err == nil {
+			t.Fatal("iterating a query that can't be parsed returned a document")
+		}
+	}
+
+	t.Log("testing contains on arrays and non-ASCII field names")
+	defer DB.Collection("Issues").Drop()
+	issues := map[string]map[string]any{
+		"issue1": {"status": "open", "priority": 1, "tags": []string{"urgent"}},
+		"issue2": {"status": "open", "priority": 5, "tags": []string{}},
+		"issue3": {"status": "closed", "priority": 5, "tags": []string{"urgent"}},
+		"issue4": {"status": "open", "priority": 2, "tags": []string{"later"}, "címkék": []string{"sürgős"}},
+	}
+	for id, data := range issues {
+		_, err := DB.Collection("Issues").Write(id, data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	example := `status == "open" AND (priority >= 3 OR tags contains "urgent")`
+	tests = []struct {
+		query    string
+		expected string
+	}{
+		{example, "issue1,issue2"},
+		{`tags contains-i "URGENT"`, "issue1,issue3"},
+		{`címkék contains "sürgős" AND státusz not-exists`, "issue4"},
+	}
+	for _, test := range tests {
+		t.Log("testing query " + test.query)
+		ids, err := DB.Collection("Issues").WhereQuery(test.query).IDs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.Join(ids, ",") != test.expected {
+			t.Fatalf("query returned %v, expected %s", ids, test.expected)
+		}
+	}
+	_, err = ParseQuery(`címkék == "a" AND ?`)
+	var query_err *QueryError
+	if !errors.As(err, &query_err) || query_err.Position != len(`címkék == "a" AND `) {
+		t.Fatalf("query with a non-ASCII field returned %v", err)
+	}
+
+	t.Log("testing query over the REST API")
+	request := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/sync/query?collection=Issues&query="+url.QueryEscape(query), nil)
+		req.Header.Set("Authorization", DB.replication_pass)
+		res := httptest.NewRecorder()
+		DB.server.Handler.ServeHTTP(res, req)
+		return res
+	}
+	res := request(example)
+	col = []Document{}
+	err = json.Unmarshal(res.Body.Bytes(), &col)
+	if res.Code != http.StatusOK || err != nil {
+		t.Fatalf("query request returned status %d - %s", res.Code, res.Body.String())
+	}
+	if len(col) != 2 || col[0].ID != "issue1" || col[1].ID != "issue2" {
+		t.Fatalf("query request returned %s", res.Body.String())
+	}
+	res = request(`status == "open" AND`)
+	response := query_error_response{}
+	err = json.Unmarshal(res.Body.Bytes(), &response)
+	if res.Code != http.StatusBadRequest || err != nil || response.Position != 20 {
+		t.Fatalf("query request that can't be parsed returned status %d - %s", res.Code, res.Body.String())
+	}
+}
+
+func Test_Search(t *testing.T) {
+	words := map[string]string{
+		"caresses": "caress", "ponies": "poni", "agreed": "agre", "hopping": "hop", "filing": "file",
+		"happy": "happi", "relational": "relat", "connection": "connect", "connected": "connect",
+		"hopefulness": "hope", "adjustment": "adjust", "controll": "control", "printers": "printer",
+	}
+	for word, expected := range words {
+		if stem(word) != expected {
+			t.Fatalf("'%s' was stemmed to '%s', expected '%s'", word, stem(word), expected)
+		}
+	}
+
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	config.Search_indexes = []string{"Tickets"}
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tickets := map[string]map[string]any{
+		"ticket1": {"Title": "Printer is broken", "Body": "The printer on the second floor stopped printing", "Status": "open"},
+		"ticket2": {"Title": "Password reset", "Body": "Please reset my password", "Status": "open"},
+		"ticket3": {"Title": "Broken chair", "Body": "", "Tags": []string{"furniture"}, "Status": "closed"},
+		"ticket4": {"Title": "New printers", "Body": "Order printers for the office", "Status": "closed"},
+	}
+	for id, data := range tickets {
+		_, err := DB.Collection("Tickets").Write(id, data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	results_ids := func(results []SearchResult) string {
+		ids := []string{}
+		for _, result := range results {
+			ids = append(ids, result.Document.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	t.Log("testing search ranking")
+	results, err := DB.Collection("Tickets").Search("broken PRINTER")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if results_ids(results) != "ticket1,ticket4,ticket3" {
+		t.Fatalf("search returned %s", results_ids(results))
+	}
+	if results[0].Score <= results[1].Score {
+		t.Fatal("results are not ordered by score")
+	}
+
+	t.Log("testing search with filter and selected fields")
+	results, err = DB.Collection("Tickets").Where("Status", "==", "closed").Select("Title").Search("printer furniture")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if results_ids(results) != "ticket3,ticket4" && results_ids(results) != "ticket4,ticket3" {
+		t.Fatalf("filtered search returned %s", results_ids(results))
+	}
+	if strings.Contains(string(results[0].Document.Data), "Status") {
+		t.Fatal("search returned fields that weren't selected")
+	}
+
+	t.Log("testing index updates")
+	_, err = DB.Collection("Tickets").Write("ticket2", map[string]any{"Title": "Printer password", "Status": "open"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DB.Collection("Tickets").Delete("ticket1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	results, err = DB.Collection("Tickets").Search("reset broken")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if results_ids(results) != "ticket3" {
+		t.Fatalf("search after update returned %s", results_ids(results))
+	}
+	index := DB.search["Tickets"]
+	if _, ok := index.docs["ticket1"]; ok || index.terms["floor"] != nil || index.terms["reset"] != nil {
+		t.Fatal("terms of replaced and deleted documents are still indexed")
+	}
+
+	t.Log("testing a document that can't be indexed isn't written")
+	err = DB.Collection("Tickets").write("ticket5", Document{ID: "ticket5", Collection: "Tickets", Data: json.RawMessage("not json")})
+	if err == nil {
+		t.Fatal("document that can't be indexed didn't return an error")
+	}
+	exists, err := DB.Collection("Tickets").Exists("ticket5")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if exists {
+		t.Fatal("document that can't be indexed was written")
+	}
+	results, err = DB.Collection("Tickets").Search("the")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 0 {
+		t.Fatal("stop words returned documents")
+	}
+	_, err = DB.Collection("Test").Search("printer")
+	if err == nil {
+		t.Fatal("search of a collection without an index didn't return an error")
+	}
+
+	t.Log("testing index is rebuilt when the database is opened")
+	err = DB.Close(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	DB, err = NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	defer ClearTestDatabase(DB)
+	results, err = DB.Collection("Tickets").Search("printers")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if results_ids(results) != "ticket4,ticket2" {
+		t.Fatalf("search after opening the database returned %s", results_ids(results))
+	}
+
+	err = DB.Collection("Tickets").Drop()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	results, err = DB.Collection("Tickets").Search("printers")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 0 {
+		t.Fatal("search returned documents of a dropped collection")
+	}
+}
+
+func Test_Explain(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	for i := range 5 {
+		_, err := DB.Collection("Test").Write(fmt.Sprintf("doc%d", i), map[string]any{"Number": i})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	t.Log("testing full scan plan")
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	plan, err := DB.Collection("Test").Where("Number", ">=", 3).Explain()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if plan.Plan != Plan_full_scan || plan.Scanned != 5 || plan.Returned != 2 || plan.Cache_hits != 0 {
+		t.Fatalf("unexpected plan %s", plan.String())
+	}
+	if plan.Decrypt_time <= 0 || plan.Duration < plan.Decrypt_time {
+		t.Fatalf("unexpected timings %s", plan.String())
+	}
+
+	t.Log("testing query cache plan")
+	plan, err = DB.Collection("Test").Where("Number", ">=", 3).Explain()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if plan.Plan != Plan_query_cache || plan.Scanned != 0 || plan.Returned != 2 {
+		t.Fatalf("unexpected plan %s", plan.String())
+	}
+
+	t.Log("testing document cache hits")
+	plan, err = DB.Collection("Test").Explain()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if plan.Plan != Plan_full_scan || plan.Scanned != 5 || plan.Returned != 5 || plan.Cache_hits != 5 {
+		t.Fatalf("unexpected plan %s", plan.String())
+	}
+
+	t.Log("testing metadata index plan")
+	plan, err = DB.Collection("Test").Where("__id", "in", []string{"doc1", "doc4"}).Explain()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if plan.Plan != Plan_metadata_index || plan.Scanned != 2 || plan.Returned != 2 {
+		t.Fatalf("unexpected plan %s", plan.String())
+	}
+
+	t.Log("testing slow query log")
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Stdout = w
+	DB.SetSlowQueryThreshold(time.Nanosecond)
+	_, err = DB.Collection("Test").Where("Number", "<", 2).Documents()
+	DB.SetSlowQueryThreshold(0)
+	_, err_fast := DB.Collection("Test").Where("Number", "<", 1).Documents()
+	os.Stdout = stdout
+	w.Close()
+	if err != nil || err_fast != nil {
+		t.Fatal("unable to run queries")
+	}
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Count(string(output), "slow query") != 1 || !strings.Contains(string(output), `"Number" < int(2)`) {
+		t.Fatalf("unexpected slow query log '%s'", string(output))
+	}
+}
+
+// Memory storage failing to read one document, counting the reads. Other reads are delayed
+// once a document is set to fail
+type failing_storage struct {
+	*memory_storage
+	fail  string
+	reads atomic.Int64
+}
+
+func (s *failing_storage) Read(collection string, id string) ([]byte, error) {
+	s.reads.Add(1)
+	if id == s.fail {
+		return nil, fmt.Errorf("unable to read '%s' - %w", id, fs.ErrPermission)
+	} else if s.fail != "" {
+		time.Sleep(time.Millisecond)
+	}
+	return s.memory_storage.Read(collection, id)
+}
+
+func Test_Parallel_Scan(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	storage := &failing_storage{memory_storage: newMemoryStorage()}
+	config.Storage_backend = storage
+	config.Scan_workers = 4
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
+	for i := range 200 {
+		_, err := DB.Collection("Test").Write(fmt.Sprintf("doc%03d", i), map[string]any{"Number": i})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	t.Log("testing documents are returned in order")
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	col, err := DB.Collection("Test").Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 200 {
+		t.Fatalf("%d documents returned, expected 200", len(col))
+	}
+	for i, doc := range col {
+		if doc.ID != fmt.Sprintf("doc%03d", i) {
+			t.Fatalf("document '%s' returned at position %d", doc.ID, i)
+		}
+	}
+	col, err = DB.Collection("Test").Where("Number", ">=", 150).Documents()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(col) != 50 || col[0].ID != "doc150" || col[49].ID != "doc199" {
+		t.Fatal("filtered documents are not what is expected")
+	}
+
+	t.Log("testing a failed read stops the scan")
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage.fail = "doc000"
+	storage.reads.Store(0)
+	_, err = DB.Collection("Test").Where("Number", ">=", 0).Documents()
+	if err == nil || !strings.Contains(err.Error(), "unable to read 'doc000'") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if storage.reads.Load() >= 50 {
+		t.Fatalf("scan read %d documents after a failed read", storage.reads.Load())
+	}
+}
+
+func Test_Iter(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	storage := &failing_storage{memory_storage: newMemoryStorage()}
+	config.Storage_backend = storage
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
+	for i := range 20 {
+		_, err := DB.Collection("Test").Write(fmt.Sprintf("doc%02d", i), map[string]any{"Number": i, "Name": fmt.Sprintf("test%d", i)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing iteration with a filter and selected fields")
+	var ids []string
+	for doc, err := range DB.Collection("Test").Where("Number", ">=", 15).Select("Name").Iter(context.Background()) {
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.Contains(string(doc.Data), "Number") {
+			t.Fatal("iterator returned fields that weren't selected")
+		}
+		ids = append(ids, doc.ID)
+	}
+	if strings.Join(ids, ",") != "doc15,doc16,doc17,doc18,doc19" {
+		t.Fatalf("iterator returned %v", ids)
+	}
+
+	t.Log("testing reading stops when the loop breaks")
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage.reads.Store(0)
+	count := 0
+	for _, err := range DB.Collection("Test").Iter(context.Background()) {
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		count++
+		if count == 3 {
+			break
+		}
+	}
+	if storage.reads.Load() != 3 {
+		t.Fatalf("iterator read %d documents, expected 3", storage.reads.Load())
+	}
+
+	t.Log("testing cancelled iteration")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	count = 0
+	var iter_err error
+	for _, err := range DB.Collection("Test").Iter(ctx) {
+		if err != nil {
+			iter_err = err
+			continue
+		}
+		count++
+		if count == 5 {
+			cancel()
+		}
+	}
+	if !errors.Is(iter_err, context.Canceled) || count != 5 {
+		t.Fatalf("cancelled iteration returned %d documents and error %v", count, iter_err)
+	}
+
+	for _, err := range DB.Collection("Test").OrderBy("Number", Order_desc).Iter(context.Background()) {
+		if err == nil {
+			t.Fatal("iteration with OrderBy didn't return an error")
+		}
+	}
+	for _, err := range DB.Collection("Missing").Iter(context.Background()) {
+		t.Fatalf("iteration of a missing collection returned %v", err)
+	}
+}
+
+func Test_Context(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+	err = ClearTestDatabase(DB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ClearTestDatabase(DB)
+
+	// Node that is slow to reply, set before any write as replication pushes read the hosts. It
+	// isn't online so writes aren't pushed to it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	DB.mutex.Lock()
+	DB.replication_hosts["slow"] = replication_host{host_address: server.URL, state: "OFFLINE"}
+	DB.mutex.Unlock()
+
+	_, err = DB.Collection("Test").WriteContext(context.Background(), "doc1", map[string]any{"Number": 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Log("testing cancelled operations")
+	_, err = DB.Collection("Test").WriteContext(cancelled, "doc2", map[string]any{"Number": 2})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("write returned %v", err)
+	}
+	_, err = DB.Collection("Test").AddContext(cancelled, map[string]any{"Number": 3})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("add returned %v", err)
+	}
+	count, err := DB.Collection("Test").Count()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 1 {
+		t.Fatal("cancelled writes were written")
+	}
+	_, err = DB.Collection("Test").DocumentContext(cancelled, "doc1")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("document returned %v", err)
+	}
+	_, err = DB.Collection("Test").DocumentsContext(cancelled)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("documents returned %v", err)
+	}
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = DB.Collection("Test").Where("Number", "==", 1).DocumentsContext(cancelled)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("filtered documents returned %v", err)
+	}
+	err = DB.Collection("Test").DeleteContext(cancelled, "doc1")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("delete returned %v", err)
+	}
+	exists, err := DB.Collection("Test").Exists("doc1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !exists {
+		t.Fatal("cancelled delete deleted the document")
+	}
+
+	t.Log("testing subscription is closed with its context")
+	ctx, cancel_sub := context.WithCancel(context.Background())
+	defer cancel_sub()
+	sub, err := DB.Collection("Test").SubscribeContext(ctx, SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cancel_sub()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snap := sub.Next()
+		if errors.Is(snap.Error, context.Canceled) {
+			break
+		} else if snap.Error != nil || time.Now().After(deadline) {
+			t.Fatalf("subscription returned %v", snap.Error)
+		}
+	}
+
+	t.Log("testing replication requests time out")
+	timeout, cancel_timeout := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel_timeout()
+	err = DB.sendDocToNode(timeout, "slow", Document{ID: "doc1", Collection: "Test"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("replication request returned %v", err)
+	}
+}
+
+func Test_Errors(t *testing.T) {
+	config, err := LoadConfig("db_config.yml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Salt = "xvq-Gn2L4TvwrFQzTCUZzGNbQ.wKbuKB-KmDXLv8iJ.2syPbheC!KkCfhwip@@Mn_X2RdfAsdE6o9-hwwErc**UwVtaxZvBLWHTd"
+	storage := &failing_storage{memory_storage: newMemoryStorage(), fail: "locked"}
+	config.Storage_backend = storage
+	DB, err := NewDB(config)
+	if err != nil {
+		t.Fatal("unable to create DB " + err.Error())
+	}
+	defer DB.Close(context.Background())
+
+	// Nodes replying with an error status, set before any write as replication pushes read the hosts
+	statuses := map[int]error{http.StatusNotFound: ErrNotFound, http.StatusUnauthorized: ErrPermission, http.StatusConflict: ErrConflict}
+	DB.mutex.Lock()
+	for status := range statuses {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(error_response{Error: "test error"})
+		}))
+		defer server.Close()
+		DB.replication_hosts[fmt.Sprint(status)] = replication_host{host_address: server.URL}
+	}
+	DB.mutex.Unlock()
+
+	_, err = DB.Collection("Test").Write("doc1", map[string]any{"Number": 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = DB.Collection("Test").Write("locked", map[string]any{"Number": 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DB.InvalidateCache("Test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Log("testing not found errors")
+	_, err = DB.Collection("Test").Document("missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("reading a missing document returned %v", err)
+	}
+	_, err = DB.Collection("Missing").Document("doc1")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("reading from a missing collection returned %v", err)
+	}
+
+	t.Log("testing invalid ID errors")
+	_, err = DB.Collection("Test").Write("", map[string]any{})
+	if !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("writing an empty ID returned %v", err)
+	}
+	_, err = DB.Collection("Test/doc1").Documents()
+	if !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("reading an invalid collection path returned %v", err)
+	}
+
+	t.Log("testing permission errors")
+	_, err = DB.Collection("Test").Document("locked")
+	if !errors.Is(err, ErrPermission) {
+		t.Fatalf("reading a denied document returned %v", err)
+	}
+	_, err = DB.Collection("Test").Where("Number", ">", 0).Documents()
+	if !errors.Is(err, ErrPermission) {
+		t.Fatalf("query reading a denied document returned %v", err)
+	}
+
+	t.Log("testing conflict errors")
+	_, err = DB.Collection("Other").Write("doc1", map[string]any{"Number": 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DB.Collection("Other").Rename("Test")
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("renaming to an existing collection returned %v", err)
+	}
+
+	t.Log("testing type mismatch errors")
+	_, err = DB.Collection("Other").Where("Number", "==", "one").Documents()
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("filter with a mismatched value returned %v", err)
+	}
+
+	t.Log("testing wrapped errors")
+	_, err = EncryptAES([]byte("short key"), []byte("data"))
+	var key_err aes.KeySizeError
+	if !errors.As(err, &key_err) {
+		t.Fatalf("encrypting with an invalid key returned %v", err)
+	}
+
+	t.Log("testing decrypt errors")
+	_, err = DB.decodeDocument([]byte("not a document"))
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("decoding an invalid document returned %v", err)
+	}
+
+	t.Log("testing replication errors")
+	for status, expected := range statuses {
+		_, err = DB.getDocFromNode(context.Background(), fmt.Sprint(status), "Test", "doc1", "")
+		if !errors.Is(err, expected) || !strings.Contains(err.Error(), "test error") {
+			t.Fatalf("status %d returned %v", status, err)
+		}
+		if errorStatus(err) == http.StatusInternalServerError {
+			t.Fatalf("error %v isn't classified", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package opendivdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+)
+
+// Iter returns an iterator over the documents matching the filter, documents are read one at a
+// time in ID order as the loop asks for them and reading stops when the loop breaks. Fields
+// selected with Select are applied, OrderBy is not supported as it needs every document.
+// Documents deleted while iterating are skipped. An error, including ctx's error once it is
+// done, is yielded once and ends the iteration. Close waits for running iterations to finish
+func (c *Collection) Iter(ctx context.Context) iter.Seq2[Document, error] {
+	return func(yield func(Document, error) bool) {
+		if err := c.driver.begin(); err != nil {
+			yield(Document{}, err)
+			return
+		}
+		defer c.driver.end()
+
+		if len(c.order) > 0 {
+			yield(Document{}, fmt.Errorf("OrderBy is not supported by Iter"))
+			return
+		}
+		if c.filter.err != nil {
+			yield(Document{}, c.filter.err)
+			return
+		}
+		if err := ValidateCollectionPath(c.collection_name); err != nil {
+			yield(Document{}, fmt.Errorf("collection name validation error - %w", err))
+			return
+		}
+
+		// list the documents of the collection, a collection that doesn't exist has no documents
+		ids, err := c.driver.storage.List(c.collection_name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return
+		} else if err != nil {
+			yield(Document{}, storageError(err))
+			return
+		}
+
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				yield(Document{}, err)
+				return
+			}
+			doc, included, err := c.readMatching(id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				yield(Document{}, err)
+				return
+			}
+			if !included {
+				continue
+			}
+
+			if len(c.fields) > 0 {
+				projected, err := projectDocuments([]Document{doc}, c.fields)
+				if err != nil {
+					yield(Document{}, err)
+					return
+				}
+				doc = projected[0]
+			}
+			if !yield(doc, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package opendivdb
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sort directions of OrderBy
+const (
+	Order_asc  = "ASC"
+	Order_desc = "DESC"
+)
+
+type order_by struct {
+	field     string // Field of the document's data or a metadata field
+	direction string // ASC or DESC
+}
+
+// Sort the documents returned by Documents by a field, further calls sort documents with
+// equal values by the next field. Fields can be metadata fields like Field_updated_at.
+// Documents missing the field come first in ascending order, values of different types are
+// ordered null, bool, number, string, others
+func (c *Collection) OrderBy(field string, direction string) *Collection {
+	c.order = append(c.order, order_by{field: field, direction: direction})
+	return c
+}
+
+// Sort a copy of documents, the documents passed in are not modified as they may be cached
+func sortDocuments(col []Document, order []order_by) ([]Document, error) {
+	for _, o := range order {
+		if o.direction != Order_asc && o.direction != Order_desc {
+			return nil, fmt.Errorf("order direction '%s' is not supported. Accepted values %s, %s", o.direction, Order_asc, Order_desc)
+		}
+	}
+
+	type sort_entry struct {
+		doc    Document
+		values []any
+	}
+	entries := make([]sort_entry, len(col))
+	for i, doc := range col {
+		var d map[string]any
+		if err := json.Unmarshal(doc.Data, &d); err != nil {
+			return nil, fmt.Errorf("unable to un-marshall document '%s' - %w", doc.ID, err)
+		}
+		entries[i] = sort_entry{doc: doc, values: make([]any, len(order))}
+		for j, o := range order {
+			// Update times are compared as times, their formatted strings don't sort in time order
+			if o.field == Field_updated_at {
+				entries[i].values[j] = doc.Updated_at
+				continue
+			}
+			entries[i].values[j], _ = fieldValue(doc, d, o.field)
+		}
+	}
+
+	// Documents with equal values keep their order by ID
+	slices.SortStableFunc(entries, func(a, b sort_entry) int {
+		for i, o := range order {
+			result := compareValues(a.values[i], b.values[i])
+			if o.direction == Order_desc {
+				result = -result
+			}
+			if result != 0 {
+				return result
+			}
+		}
+		return 0
+	})
+
+	sorted := make([]Document, len(entries))
+	for i, entry := range entries {
+		sorted[i] = entry.doc
+	}
+	return sorted, nil
+}
+
+// Compare two values decoded from JSON
+func compareValues(a any, b any) int {
+	if result := cmp.Compare(typeRank(a), typeRank(b)); result != 0 {
+		return result
+	}
+	switch real := a.(type) {
+	case bool:
+		if real == b.(bool) {
+			return 0
+		} else if real {
+			return 1
+		}
+		return -1
+	case float64:
+		return cmp.Compare(real, b.(float64))
+	case string:
+		return strings.Compare(real, b.(string))
+	case time.Time:
+		if real.Equal(b.(time.Time)) {
+			return 0
+		} else if real.Before(b.(time.Time)) {
+			return -1
+		}
+		return 1
+	case nil:
+		return 0
+	}
+	// Arrays and objects are compared by their JSON
+	a_b, _ := json.Marshal(a)
+	b_b, _ := json.Marshal(b)
+	return strings.Compare(string(a_b), string(b_b))
+}
+
+func typeRank(value any) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case time.Time:
+		return 4
+	}
+	return 5
+}
@@ -0,0 +1,72 @@
+package opendivdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Copy documents keeping only the selected fields in their Data, the documents passed in are
+// not modified as they may be cached
+func projectDocuments(col []Document, fields []string) ([]Document, error) {
+	projected := make([]Document, len(col))
+	for i, doc := range col {
+		data, err := projectData(doc.Data, fields)
+		if err != nil {
+			return nil, fmt.Errorf("unable to select fields of document '%s' - %w", doc.ID, err)
+		}
+		doc.Data = data
+		projected[i] = doc
+	}
+	return projected, nil
+}
+
+// Keep only the selected fields of a JSON object, fields missing from the object are left out
+func projectData(data json.RawMessage, fields []string) (json.RawMessage, error) {
+	// Numbers are kept as they are written in the document
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var d map[string]any
+	if err := decoder.Decode(&d); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]any)
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		value, ok := lookupPath(d, path)
+		if !ok {
+			continue
+		}
+		setPath(out, path, value)
+	}
+	return json.Marshal(out)
+}
+
+// Value of a dot separated path in a JSON object
+func lookupPath(d map[string]any, path []string) (any, bool) {
+	value, ok := d[path[0]]
+	if !ok || len(path) == 1 {
+		return value, ok
+	}
+	nested, ok := value.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return lookupPath(nested, path[1:])
+}
+
+// Set a value at a dot separated path in a JSON object, creating the objects along the path
+func setPath(d map[string]any, path []string, value any) {
+	if len(path) == 1 {
+		d[path[0]] = value
+		return
+	}
+	nested, ok := d[path[0]].(map[string]any)
+	if !ok {
+		nested = make(map[string]any)
+		d[path[0]] = nested
+	}
+	setPath(nested, path[1:], value)
+}
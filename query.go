@@ -0,0 +1,305 @@
+package opendivdb
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+
+Query language
+	query     = and { "OR" and }
+	and       = primary { "AND" primary }
+	primary   = "(" query ")" | condition
+	condition = field operator value | field ( "exists" | "not-exists" )
+	value     = string | number | "true" | "false" | "null" | "[" [ value { "," value } ] "]" | "time(" string ")"
+
+	Fields are names of the document's data or metadata fields (__id, __updated_at, __hash),
+	operators are the ones accepted by Where. Strings are double quoted with Go escapes, time()
+	takes a time string read the way time filters read document fields. AND and OR are case-insensitive, AND binds stronger
+	e.g. status == "open" AND (priority >= 3 OR title contains-i "urgent")
+
+*/
+
+// QueryError is returned when a query can't be parsed, Position is the byte offset in the
+// query where the error was found
+type QueryError struct {
+	Position int
+	Message  string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position)
+}
+
+// Types of query tokens
+const (
+	token_end = iota
+	token_word
+	token_string
+	token_number
+	token_symbol
+)
+
+type (
+	query_token struct {
+		kind     int
+		text     string // Word, symbol or number as written, unquoted string value
+		position int
+	}
+
+	query_parser struct {
+		tokens []query_token
+		next   int
+	}
+)
+
+// ParseQuery parses a query into a filter that can be applied with Collection.WhereQuery
+func ParseQuery(query string) (Filter, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return Filter{}, err
+	}
+	p := &query_parser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return Filter{}, err
+	}
+	if token := p.peek(); token.kind != token_end {
+		return Filter{}, &QueryError{Position: token.position, Message: fmt.Sprintf("unexpected '%s'", token.text)}
+	}
+	return f, nil
+}
+
+// Filter the collection with a query, see ParseQuery. A query that can't be parsed is
+// returned as an error by Documents
+func (c *Collection) WhereQuery(query string) *Collection {
+	f, err := ParseQuery(query)
+	if err != nil {
+		f = Filter{err: err}
+	}
+	c.filter = f
+	return c
+}
+
+// Split a query into tokens, the query is read by rune so field names can hold any letter
+func tokenizeQuery(query string) ([]query_token, error) {
+	var tokens []query_token
+	for i := 0; i < len(query); {
+		r, size := utf8.DecodeRuneInString(query[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '"':
+			// Find the closing quote, skipping escaped characters
+			end := i + 1
+			for end < len(query) && query[end] != '"' {
+				if query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				return nil, &QueryError{Position: i, Message: "unterminated string"}
+			}
+			value, err := strconv.Unquote(query[i : end+1])
+			if err != nil {
+				return nil, &QueryError{Position: i, Message: "invalid string " + query[i:end+1]}
+			}
+			tokens = append(tokens, query_token{kind: token_string, text: value, position: i})
+			i = end + 1
+		case r == '-' || r == '.' || unicode.IsDigit(r):
+			end := i + size
+			for end < len(query) && strings.ContainsRune("0123456789.eE+-", rune(query[end])) {
+				end++
+			}
+			if _, err := strconv.ParseFloat(query[i:end], 64); err != nil {
+				return nil, &QueryError{Position: i, Message: "invalid number " + query[i:end]}
+			}
+			tokens = append(tokens, query_token{kind: token_number, text: query[i:end], position: i})
+			i = end
+		case r == '_' || unicode.IsLetter(r):
+			end := i + size
+			for end < len(query) {
+				next, next_size := utf8.DecodeRuneInString(query[end:])
+				if next != '_' && next != '-' && next != '.' && !unicode.IsLetter(next) && !unicode.IsDigit(next) {
+					break
+				}
+				end += next_size
+			}
+			tokens = append(tokens, query_token{kind: token_word, text: query[i:end], position: i})
+			i = end
+		default:
+			// Two character symbols first
+			if i+1 < len(query) && slices.Contains([]string{"==", "!=", "<=", ">="}, query[i:i+2]) {
+				tokens = append(tokens, query_token{kind: token_symbol, text: query[i : i+2], position: i})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("<>()[],", r) {
+				return nil, &QueryError{Position: i, Message: fmt.Sprintf("unexpected character '%c'", r)}
+			}
+			tokens = append(tokens, query_token{kind: token_symbol, text: string(r), position: i})
+			i += size
+		}
+	}
+	return append(tokens, query_token{kind: token_end, text: "end of query", position: len(query)}), nil
+}
+
+func (p *query_parser) peek() query_token {
+	return p.tokens[p.next]
+}
+
+func (p *query_parser) advance() query_token {
+	token := p.tokens[p.next]
+	if token.kind != token_end {
+		p.next++
+	}
+	return token
+}
+
+// Check if the next token is a keyword, keywords are case-insensitive
+func (p *query_parser) isKeyword(keyword string) bool {
+	token := p.peek()
+	return token.kind == token_word && strings.EqualFold(token.text, keyword)
+}
+
+func (p *query_parser) parseOr() (Filter, error) {
+	return p.parseLogic(filter_or, p.parseAnd)
+}
+
+func (p *query_parser) parseAnd() (Filter, error) {
+	return p.parseLogic(filter_and, p.parsePrimary)
+}
+
+// Parse operands separated by a keyword, a single operand is returned as is
+func (p *query_parser) parseLogic(logic string, operand func() (Filter, error)) (Filter, error) {
+	f, err := operand()
+	if err != nil {
+		return Filter{}, err
+	}
+	filters := []Filter{f}
+	for p.isKeyword(logic) {
+		p.advance()
+		f, err := operand()
+		if err != nil {
+			return Filter{}, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return Filter{logic: logic, filters: filters}, nil
+}
+
+func (p *query_parser) parsePrimary() (Filter, error) {
+	token := p.advance()
+	if token.kind == token_symbol && token.text == "(" {
+		f, err := p.parseOr()
+		if err != nil {
+			return Filter{}, err
+		}
+		if closing := p.advance(); closing.text != ")" || closing.kind != token_symbol {
+			return Filter{}, &QueryError{Position: closing.position, Message: fmt.Sprintf("expected ')' but found '%s'", closing.text)}
+		}
+		return f, nil
+	}
+	if token.kind != token_word {
+		return Filter{}, &QueryError{Position: token.position, Message: fmt.Sprintf("expected a field name but found '%s'", token.text)}
+	}
+	field := token.text
+
+	operator := p.advance()
+	if (operator.kind != token_word && operator.kind != token_symbol) || !slices.Contains(filter_operators, operator.text) {
+		return Filter{}, &QueryError{Position: operator.position, Message: fmt.Sprintf("expected an operator but found '%s'", operator.text)}
+	}
+	if operator.text == "exists" || operator.text == "not-exists" {
+		return newFilter(field, operator.text, nil), nil
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return Filter{}, err
+	}
+	f := newFilter(field, operator.text, value)
+	if f.err != nil {
+		return Filter{}, &QueryError{Position: operator.position, Message: f.err.Error()}
+	}
+	return f, nil
+}
+
+func (p *query_parser) parseValue() (any, error) {
+	token := p.advance()
+	switch token.kind {
+	case token_string:
+		return token.text, nil
+	case token_number:
+		number, _ := strconv.ParseFloat(token.text, 64)
+		return number, nil
+	case token_word:
+		switch token.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		case "time":
+			return p.parseTime()
+		}
+	case token_symbol:
+		if token.text == "[" {
+			return p.parseList()
+		}
+	}
+	return nil, &QueryError{Position: token.position, Message: fmt.Sprintf("expected a value but found '%s'", token.text)}
+}
+
+// Parse the rest of a list after "["
+func (p *query_parser) parseList() (any, error) {
+	values := []any{}
+	if token := p.peek(); token.kind == token_symbol && token.text == "]" {
+		p.advance()
+		return values, nil
+	}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		token := p.advance()
+		if token.kind == token_symbol && token.text == "]" {
+			return values, nil
+		}
+		if token.kind != token_symbol || token.text != "," {
+			return nil, &QueryError{Position: token.position, Message: fmt.Sprintf("expected ',' or ']' but found '%s'", token.text)}
+		}
+	}
+}
+
+// Parse the rest of time("...") after the time keyword
+func (p *query_parser) parseTime() (any, error) {
+	if token := p.advance(); token.kind != token_symbol || token.text != "(" {
+		return nil, &QueryError{Position: token.position, Message: fmt.Sprintf("expected '(' but found '%s'", token.text)}
+	}
+	token := p.advance()
+	if token.kind != token_string {
+		return nil, &QueryError{Position: token.position, Message: fmt.Sprintf("expected a time string but found '%s'", token.text)}
+	}
+	// Times are read the same way as the document fields they are compared to
+	value, err := parseTime(token.text)
+	if err != nil {
+		return nil, &QueryError{Position: token.position, Message: "time is not RFC3339 formatted or a date"}
+	}
+	if closing := p.advance(); closing.kind != token_symbol || closing.text != ")" {
+		return nil, &QueryError{Position: closing.position, Message: fmt.Sprintf("expected ')' but found '%s'", closing.text)}
+	}
+	return value, nil
+}
@@ -0,0 +1,145 @@
+package opendivdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+type (
+	// Results of Documents() calls keyed by collection and filter. A cached result is
+	// removed when a document written to or deleted from its collection was, or now is,
+	// part of the result
+	query_cache struct {
+		queries       map[string]*cached_query            // Cached results keyed by collection and filter
+		by_collection map[string]map[string]*cached_query // Cached results of each collection
+		order         *list.List                          // Cached results ordered by most recent use
+		generations   map[string]uint64                   // Incremented on every change to a collection
+		limit         int                                 // Maximum number of cached results, negative to disable
+		hits          uint64
+		misses        uint64
+		mutex         sync.Mutex
+	}
+
+	cached_query struct {
+		key        string
+		collection string
+		filter     Filter
+		ids        map[string]bool // IDs of documents in the result
+		documents  []Document
+		element    *list.Element
+	}
+)
+
+func newQueryCache(limit int) query_cache {
+	return query_cache{
+		queries:       make(map[string]*cached_query),
+		by_collection: make(map[string]map[string]*cached_query),
+		order:         list.New(),
+		generations:   make(map[string]uint64),
+		limit:         limit,
+	}
+}
+
+// Return a copy of a cached result
+func (q *query_cache) get(collection_name string, filter Filter) ([]Document, bool) {
+	if q.limit < 0 {
+		return nil, false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	query, ok := q.queries[collection_name+"|"+filter.key()]
+	if !ok {
+		q.misses++
+		return nil, false
+	}
+	q.hits++
+	q.order.MoveToFront(query.element)
+
+	col := make([]Document, len(query.documents))
+	for i, doc := range query.documents {
+		doc.From_cache = true
+		col[i] = doc
+	}
+	return col, true
+}
+
+// Current generation of a collection, must be taken before the query is run so a result
+// computed while the collection changed isn't cached
+func (q *query_cache) generation(collection_name string) uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.generations[collection_name]
+}
+
+func (q *query_cache) add(collection_name string, filter Filter, generation uint64, col []Document) {
+	if q.limit < 0 {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Collection changed while the query was running
+	if q.generations[collection_name] != generation {
+		return
+	}
+
+	key := collection_name + "|" + filter.key()
+	if query, ok := q.queries[key]; ok {
+		q.remove(query)
+	}
+	for q.order.Len() > 0 && q.order.Len() >= q.limit {
+		q.remove(q.order.Back().Value.(*cached_query))
+	}
+
+	query := &cached_query{key: key, collection: collection_name, filter: filter, ids: make(map[string]bool, len(col)), documents: make([]Document, len(col))}
+	copy(query.documents, col)
+	for _, doc := range col {
+		query.ids[doc.ID] = true
+	}
+	query.element = q.order.PushFront(query)
+	q.queries[key] = query
+	if _, ok := q.by_collection[collection_name]; !ok {
+		q.by_collection[collection_name] = make(map[string]*cached_query)
+	}
+	q.by_collection[collection_name][key] = query
+}
+
+// Remove cached results of a collection affected by a written or deleted document
+func (q *query_cache) invalidate(collection_name string, doc Document) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.generations[collection_name]++
+	for _, query := range q.by_collection[collection_name] {
+		if !query.filter.isSet() || query.ids[doc.ID] {
+			q.remove(query)
+			continue
+		}
+		// Remove the result if the document is now included or it can't be determined
+		if included, err := query.filter.included(doc); err != nil || included {
+			q.remove(query)
+		}
+	}
+}
+
+// Remove every cached result of a collection
+func (q *query_cache) invalidateCollection(collection_name string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.generations[collection_name]++
+	for _, query := range q.by_collection[collection_name] {
+		q.remove(query)
+	}
+}
+
+// Must be called with the query cache mutex held
+func (q *query_cache) remove(query *cached_query) {
+	q.order.Remove(query.element)
+	delete(q.queries, query.key)
+	delete(q.by_collection[query.collection], query.key)
+	if len(q.by_collection[query.collection]) == 0 {
+		delete(q.by_collection, query.collection)
+	}
+}
@@ -15,17 +15,24 @@ Sync Idea (peer 1, 2 and 3)
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+func init() {
+	gin.ForceConsoleColor()
+	gin.SetMode(gin.ReleaseMode)
+}
+
 type (
 	replication_host struct {
 		host_address string
@@ -41,8 +48,17 @@ type (
 	error_response struct {
 		Error string `json:"error,omitempty"`
 	}
+
+	// Response to a query that can't be parsed, Position is the byte offset of the error in the query
+	query_error_response struct {
+		Error    string `json:"error"`
+		Position int    `json:"position"`
+	}
 )
 
+// Time allowed for a replication request to another node
+const replication_timeout = 10 * time.Second
+
 // Set Document stat into memory
 func (d *Driver) setDocState(collection string, doc Document) {
 	d.mutex.Lock()
@@ -51,6 +67,14 @@ func (d *Driver) setDocState(collection string, doc Document) {
 	d.doc_state[collection+"/"+doc.ID] = doc_state
 }
 
+// Get a document state from memory
+func (d *Driver) getDocState(collection string, id string) (doc_state, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	state, ok := d.doc_state[collection+"/"+id]
+	return state, ok
+}
+
 // Remove a document state from memory
 func (d *Driver) removeDocState(collection string, id string) {
 	d.mutex.Lock()
@@ -58,23 +82,26 @@ func (d *Driver) removeDocState(collection string, id string) {
 	delete(d.doc_state, collection+"/"+id)
 }
 
-// Load each document's current state into the memory
+// Load each document's current state into the memory and build the search indexes
 func (d *Driver) loadDocState() error {
 	// Get all collection names
-	entries, err := os.ReadDir(d.dir)
+	collections, err := d.storage.Collections()
 	if err != nil {
 		return nil
 	}
 	// For each collection
-	for _, dir := range entries {
-		if dir.IsDir() {
-			col, err := d.Collection(dir.Name()).Documents()
+	for _, name := range collections {
+		col, err := d.Collection(name).Documents()
+		if err != nil {
+			return err
+		}
+		for _, doc := range col {
+			d.setDocState(name, doc)
+			terms, err := d.indexTerms(name, doc)
 			if err != nil {
 				return err
 			}
-			for _, doc := range col {
-				d.setDocState(dir.Name(), doc)
-			}
+			d.indexDocument(name, doc.ID, terms)
 		}
 	}
 	return nil
@@ -94,7 +121,7 @@ func (d *Driver) getDocStateAfter(timestamp time.Time) map[string]doc_state {
 func (d *Driver) checkReplicationPass(c *gin.Context) {
 	pass := c.GetHeader("Authorization")
 	if pass != d.replication_pass {
-		c.JSON(http.StatusUnauthorized, error_response{Error: "unauthorized"})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, error_response{Error: ErrPermission.Error()})
 		return
 	}
 	c.Next()
@@ -160,9 +187,9 @@ func (d *Driver) GETDoc(c *gin.Context) {
 	hash := c.Query("hash")
 
 	if hash != d.doc_state[collection+"/"+document_id].Hash {
-		doc, err := d.Collection(collection).Document(document_id)
+		doc, err := d.Collection(collection).DocumentContext(c.Request.Context(), document_id)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, error_response{Error: err.Error()})
+			c.JSON(errorStatus(err), error_response{Error: err.Error()})
 			return
 		}
 		c.JSON(http.StatusOK, doc)
@@ -178,23 +205,135 @@ func (d *Driver) POSTDoc(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, error_response{Error: err.Error()})
 	}
 
+	if err = d.begin(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, error_response{Error: err.Error()})
+		return
+	}
+	defer d.end()
+
 	// Save replicated file to local file system
 	if err = d.Collection(doc.Collection).write(doc.ID, doc); err != nil {
-		c.JSON(http.StatusInternalServerError, error_response{Error: err.Error()})
+		c.JSON(errorStatus(err), error_response{Error: err.Error()})
+	}
+}
+
+// URL ARGS: collection=test
+func (d *Driver) DELETECollection(c *gin.Context) {
+	collection := c.Query("collection")
+	if collection == "" {
+		c.JSON(http.StatusBadRequest, error_response{Error: "'collection' was not provided"})
+		return
+	}
+	if err := ValidateCollectionPath(collection); err != nil {
+		c.JSON(http.StatusBadRequest, error_response{Error: err.Error()})
+		return
+	}
+
+	if err := d.begin(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, error_response{Error: err.Error()})
+		return
+	}
+	defer d.end()
+
+	// Drop the collection without replicating it back
+	if err := d.Collection(collection).drop(); err != nil {
+		c.JSON(errorStatus(err), error_response{Error: err.Error()})
 	}
 }
 
+// URL ARGS: collection=test,query=status == "open", see ParseQuery for the query language
+func (d *Driver) GETQuery(c *gin.Context) {
+	collection := c.Query("collection")
+	if collection == "" {
+		c.JSON(http.StatusBadRequest, error_response{Error: "'collection' was not provided"})
+		return
+	}
+	f, err := ParseQuery(c.Query("query"))
+	if err != nil {
+		query_err := &QueryError{}
+		if errors.As(err, &query_err) {
+			c.JSON(http.StatusBadRequest, query_error_response{Error: query_err.Error(), Position: query_err.Position})
+			return
+		}
+		c.JSON(http.StatusBadRequest, error_response{Error: err.Error()})
+		return
+	}
+
+	col := d.Collection(collection)
+	col.filter = f
+	docs, err := col.DocumentsContext(c.Request.Context())
+	if err != nil {
+		c.JSON(errorStatus(err), error_response{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, docs)
+}
+
+// HTTP status of an error returned to another node
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidID), errors.Is(err, ErrTypeMismatch):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrPermission):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// Error of a response from another node, the status is classified as one of the database's errors
+func responseError(res *http.Response) error {
+	response := error_response{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil || response.Error == "" {
+		response.Error = res.Status
+	}
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%w - %s", ErrNotFound, response.Error)
+	case http.StatusBadRequest:
+		return fmt.Errorf("%w - %s", ErrInvalidID, response.Error)
+	case http.StatusConflict:
+		return fmt.Errorf("%w - %s", ErrConflict, response.Error)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w - %s", ErrPermission, response.Error)
+	}
+	return errors.New(response.Error)
+}
+
+// Copy of the replication hosts taken under the driver mutex, GETSync updates the hosts while
+// changes are pushed
+func (d *Driver) replicationHosts() map[string]replication_host {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	hosts := make(map[string]replication_host, len(d.replication_hosts))
+	for id, host := range d.replication_hosts {
+		hosts[id] = host
+	}
+	return hosts
+}
+
+// Get a replication host under the driver mutex
+func (d *Driver) replicationHost(node_id string) replication_host {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.replication_hosts[node_id]
+}
+
 // Function to send Doc to specific node
-func (d *Driver) sendDocToNode(node_id string, document Document) error {
+func (d *Driver) sendDocToNode(ctx context.Context, node_id string, document Document) error {
 	client := http.Client{}
 
 	doc_b, err := json.Marshal(document)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(
+		ctx,
 		"POST",
-		fmt.Sprintf("%s/api/sync/doc", d.replication_hosts[node_id].host_address),
+		fmt.Sprintf("%s/api/sync/doc", d.replicationHost(node_id).host_address),
 		bytes.NewBuffer(doc_b),
 	)
 	if err != nil {
@@ -206,15 +345,10 @@ func (d *Driver) sendDocToNode(node_id string, document Document) error {
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		response := error_response{}
-		err := json.NewDecoder(res.Body).Decode(&response)
-		if err != nil {
-			return fmt.Errorf(fmt.Sprintf("following error occurred while pushing change to node '%s' - %s", node_id, err.Error()))
-		}
-		// Update bellow error message
-		return fmt.Errorf(fmt.Sprintf("following error occurred while pushing change to node '%s' - %s", node_id, response.Error))
+		return fmt.Errorf("following error occurred while pushing change to node '%s' - %w", node_id, responseError(res))
 	}
 
 	return nil
@@ -222,45 +356,81 @@ func (d *Driver) sendDocToNode(node_id string, document Document) error {
 
 // Function to broadcast changes to all nodes (wrap sending a doc to single node into a loop)
 func (d *Driver) sendDocToAllNodes(doc Document) {
-	for id, node := range d.replication_hosts {
+	for id, node := range d.replicationHosts() {
 		if node.state == "ONLINE" {
-			if err := d.sendDocToNode(id, doc); err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), replication_timeout)
+			if err := d.sendDocToNode(ctx, id, doc); err != nil {
 				fmt.Println("[error] " + err.Error())
 			}
+			cancel()
 		}
 	}
 }
 
-func (d *Driver) getDocFromNode(node_id string, collection string, doc_id string, hash string) (Document, error) {
+// Function to send a collection drop to a specific node
+func (d *Driver) sendDropToNode(ctx context.Context, node_id string, collection string) error {
 	client := http.Client{}
-	req, err := http.NewRequest(
-		"GET",
-		fmt.Sprintf("%s/api/sync/doc?collection=%s&document_id=%s&hash=%s", d.replication_hosts[node_id].host_address, collection, doc_id, hash),
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"DELETE",
+		fmt.Sprintf("%s/api/sync/collection?collection=%s", d.replicationHost(node_id).host_address, url.QueryEscape(collection)),
 		nil,
 	)
 	if err != nil {
-		return Document{}, err
+		return err
 	}
 
 	req.Header.Add("Authorization", d.replication_pass)
 	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("following error occurred while dropping collection on node '%s' - %w", node_id, responseError(res))
+	}
+	return nil
+}
+
+// Function to broadcast a collection drop to all nodes
+func (d *Driver) sendDropToAllNodes(collection string) {
+	for id, node := range d.replicationHosts() {
+		if node.state == "ONLINE" {
+			ctx, cancel := context.WithTimeout(context.Background(), replication_timeout)
+			if err := d.sendDropToNode(ctx, id, collection); err != nil {
+				fmt.Println("[error] " + err.Error())
+			}
+			cancel()
+		}
+	}
+}
+
+func (d *Driver) getDocFromNode(ctx context.Context, node_id string, collection string, doc_id string, hash string) (Document, error) {
+	client := http.Client{}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"GET",
+		fmt.Sprintf("%s/api/sync/doc?collection=%s&document_id=%s&hash=%s", d.replicationHost(node_id).host_address, collection, doc_id, hash),
+		nil,
+	)
 	if err != nil {
 		return Document{}, err
 	}
 
-	res_b, err := io.ReadAll(res.Body)
+	req.Header.Add("Authorization", d.replication_pass)
+	res, err := client.Do(req)
 	if err != nil {
-		return Document{}, fmt.Errorf("error occurred wile reading response %s", err.Error())
+		return Document{}, err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		response := error_response{}
-		err := json.Unmarshal(res_b, &response)
-		if err != nil {
-			return Document{}, err
-		}
-		// Update bellow error message
-		return Document{}, err
+		return Document{}, fmt.Errorf("following error occurred while getting document from node '%s' - %w", node_id, responseError(res))
+	}
+	res_b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return Document{}, fmt.Errorf("error occurred wile reading response %w", err)
 	}
 	doc := Document{}
 	err = json.Unmarshal(res_b, &doc)
@@ -270,22 +440,28 @@ func (d *Driver) getDocFromNode(node_id string, collection string, doc_id string
 	return doc, nil
 }
 
-// Main Sync Go Routine
-func (d *Driver) runReplication() {
-	// Define replication endpoints (Gin)
-	gin.ForceConsoleColor()
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+// Build the replication listener with its endpoints (Gin)
+func (d *Driver) replicationServer() *http.Server {
+	r := gin.New()
+	r.Use(gin.Logger(), gin.Recovery())
 	sync := r.Group("/api/sync")
 	sync.Use(d.checkReplicationPass)
 	{
-		r.GET("", d.GETSync)
-		r.GET("/doc", d.GETDoc)
-		r.POST("/doc", d.POSTDoc)
+		sync.GET("", d.GETSync)
+		sync.GET("/doc", d.GETDoc)
+		sync.POST("/doc", d.POSTDoc)
+		sync.DELETE("/collection", d.DELETECollection)
+		sync.GET("/query", d.GETQuery)
 	}
+	return &http.Server{Addr: ":" + strconv.Itoa(d.replication_port), Handler: r}
+}
 
-	// Start goroutine to listen to replication requests
-	r.Run(":" + strconv.Itoa(d.replication_port))
+// Main Sync Go Routine
+func (d *Driver) runReplication() {
+	// Listen to replication requests until the driver is closed
+	if err := d.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Println("[ERROR] replication listener stopped " + err.Error())
+	}
 
 	// Broadcast that you are SYNCING. Peers, will reply with the doc state		<- Endpoint to create /api/sync?state=SYNCING
 	// Request all out of sync docs from one peer
@@ -0,0 +1,50 @@
+package opendivdb
+
+import (
+	"context"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Read documents with the driver's scan workers, read returns the document and if it is part of
+// the result. Documents are returned in the order of ids, the first error or ctx being done
+// stops the scan
+func (c *Collection) scanDocuments(ctx context.Context, ids []string, read func(id string) (Document, bool, error)) ([]Document, error) {
+	docs := make([]Document, len(ids))
+	included := make([]bool, len(ids))
+
+	group, group_ctx := errgroup.WithContext(ctx)
+	group.SetLimit(c.driver.scan_workers)
+	for i, id := range ids {
+		// Stop starting reads once a read failed or ctx is done
+		if group_ctx.Err() != nil {
+			break
+		}
+		group.Go(func() error {
+			if err := group_ctx.Err(); err != nil {
+				return err
+			}
+			doc, ok, err := read(id)
+			if err != nil {
+				return err
+			}
+			docs[i], included[i] = doc, ok
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	// ctx may be done before any read was started
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var col []Document
+	for i, doc := range docs {
+		if included[i] {
+			col = append(col, doc)
+		}
+	}
+	return col, nil
+}
@@ -0,0 +1,253 @@
+package opendivdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 relevance scoring parameters
+const (
+	search_k1 = 1.2
+	search_b  = 0.75
+)
+
+type (
+	// Inverted index of the words in the string fields of a collection's documents
+	search_index struct {
+		terms   map[string]map[string]int // Stemmed term to the number of times each document holds it
+		docs    map[string][]string       // Distinct terms of each document, so a document is removed without going through every term
+		lengths map[string]int            // Number of terms of each document
+		total   int                       // Number of terms of all documents
+		mutex   sync.RWMutex
+	}
+
+	// Document returned by Search with its relevance to the searched text
+	SearchResult struct {
+		Document Document
+		Score    float64
+	}
+)
+
+// Common English words that are not indexed
+var search_stop_words = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true,
+	"not": true, "of": true, "on": true, "or": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true, "this": true, "to": true,
+	"was": true, "will": true, "with": true,
+}
+
+func newSearchIndex() *search_index {
+	return &search_index{terms: make(map[string]map[string]int), docs: make(map[string][]string), lengths: make(map[string]int)}
+}
+
+// Index the terms of a document, replacing what was indexed for it before
+func (s *search_index) add(id string, terms []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remove(id)
+	for _, term := range terms {
+		if s.terms[term] == nil {
+			s.terms[term] = make(map[string]int)
+		}
+		if s.terms[term][id] == 0 {
+			s.docs[id] = append(s.docs[id], term)
+		}
+		s.terms[term][id]++
+	}
+	s.lengths[id] = len(terms)
+	s.total += len(terms)
+}
+
+// Remove a document from the index, the mutex must be held
+func (s *search_index) remove(id string) {
+	length, ok := s.lengths[id]
+	if !ok {
+		return
+	}
+	for _, term := range s.docs[id] {
+		docs := s.terms[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(s.terms, term)
+		}
+	}
+	delete(s.docs, id)
+	delete(s.lengths, id)
+	s.total -= length
+}
+
+func (s *search_index) delete(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remove(id)
+}
+
+func (s *search_index) clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.terms = make(map[string]map[string]int)
+	s.docs = make(map[string][]string)
+	s.lengths = make(map[string]int)
+	s.total = 0
+}
+
+// Score the documents holding any of the terms with BM25
+func (s *search_index) score(terms []string) map[string]float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	scores := make(map[string]float64)
+	if len(s.lengths) == 0 {
+		return scores
+	}
+	documents := float64(len(s.lengths))
+	average_length := float64(s.total) / documents
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+
+		docs := s.terms[term]
+		idf := math.Log(1 + (documents-float64(len(docs))+0.5)/(float64(len(docs))+0.5))
+		for id, frequency := range docs {
+			tf := float64(frequency)
+			norm := 1 - search_b + search_b*float64(s.lengths[id])/average_length
+			scores[id] += idf * tf * (search_k1 + 1) / (tf + search_k1*norm)
+		}
+	}
+	return scores
+}
+
+// Search returns the documents of the collection holding any word of text in one of their
+// string fields, most relevant first. Words are matched by their English stem ignoring case,
+// the collection must be listed in the Search_indexes configuration. A filter set with Where
+// is applied to the results and Select picks the returned fields
+func (c *Collection) Search(text string) ([]SearchResult, error) {
+	if err := c.driver.begin(); err != nil {
+		return nil, err
+	}
+	defer c.driver.end()
+
+	err := ValidateCollectionPath(c.collection_name)
+	if err != nil {
+		return nil, fmt.Errorf("collection name validation error - %w", err)
+	}
+	index, ok := c.driver.search[c.collection_name]
+	if !ok {
+		return nil, fmt.Errorf("collection '%s' has no search index", c.collection_name)
+	}
+	if c.filter.err != nil {
+		return nil, c.filter.err
+	}
+
+	scores := index.score(searchTerms(text))
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		doc, err := c.read(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read document '%s' - %w", id, err)
+		}
+		if c.filter.isSet() {
+			included, err := c.filter.included(doc)
+			if err != nil {
+				return nil, err
+			}
+			if !included {
+				continue
+			}
+		}
+		results = append(results, SearchResult{Document: doc, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Document.ID < results[j].Document.ID
+	})
+
+	if len(c.fields) > 0 {
+		for i := range results {
+			projected, err := projectDocuments([]Document{results[i].Document}, c.fields)
+			if err != nil {
+				return nil, err
+			}
+			results[i].Document = projected[0]
+		}
+	}
+	return results, nil
+}
+
+// Terms of a document to add to the search index of its collection, nil if the collection has
+// no search index. Documents are tokenized before they are written so a document that can't be
+// indexed isn't written
+func (d *Driver) indexTerms(collection_name string, doc Document) ([]string, error) {
+	if _, ok := d.search[collection_name]; !ok {
+		return nil, nil
+	}
+	var data any
+	if err := json.Unmarshal(doc.Data, &data); err != nil {
+		return nil, fmt.Errorf("unable to index document '%s' - %w", doc.ID, err)
+	}
+	var terms []string
+	for _, text := range stringValues(data, nil) {
+		terms = append(terms, searchTerms(text)...)
+	}
+	return terms, nil
+}
+
+// Add the terms of a document to the search index of its collection, if the collection has one
+func (d *Driver) indexDocument(collection_name string, id string, terms []string) {
+	if index, ok := d.search[collection_name]; ok {
+		index.add(id, terms)
+	}
+}
+
+// Remove a document from the search index of its collection, if the collection has one
+func (d *Driver) unindexDocument(collection_name string, id string) {
+	if index, ok := d.search[collection_name]; ok {
+		index.delete(id)
+	}
+}
+
+// Every string of a decoded JSON value, including the ones in nested objects and arrays
+func stringValues(value any, values []string) []string {
+	switch v := value.(type) {
+	case string:
+		values = append(values, v)
+	case []any:
+		for _, item := range v {
+			values = stringValues(item, values)
+		}
+	case map[string]any:
+		for _, item := range v {
+			values = stringValues(item, values)
+		}
+	}
+	return values
+}
+
+// Split text into lower case words, leaving out stop words, and stem them
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if search_stop_words[word] {
+			continue
+		}
+		terms = append(terms, stem(word))
+	}
+	return terms
+}
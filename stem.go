@@ -0,0 +1,226 @@
+package opendivdb
+
+import "strings"
+
+/*
+
+English stemmer, the Porter algorithm (M.F. Porter, 1980)
+	A word is read as [C](VC){m}[V] where C and V are sequences of consonants and vowels,
+	m is the measure of the word. Suffixes are removed or replaced in five steps when the
+	measure of what is left satisfies the step's condition, e.g. connected, connecting and
+	connection are all stemmed to connect
+*/
+
+type (
+	porter_word []byte
+
+	// Suffix replaced by a step of the stemmer
+	porter_rule struct {
+		suffix      string
+		replacement string
+	}
+)
+
+var (
+	porter_step2 = []porter_rule{
+		{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+		{"abli", "able"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+		{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+		{"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	}
+	porter_step3 = []porter_rule{
+		{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"},
+		{"ful", ""}, {"ness", ""},
+	}
+	// Longer suffixes come before the suffixes they end with
+	porter_step4 = []string{
+		"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment", "ent", "ion",
+		"ou", "ism", "ate", "iti", "ous", "ive", "ize",
+	}
+)
+
+// Stem a lower case word, words that are short or not plain ASCII letters are returned as is
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for _, r := range word {
+		if r < 'a' || r > 'z' {
+			return word
+		}
+	}
+	w := porter_word(word)
+	w = w.step1a()
+	w = w.step1b()
+	w = w.step1c()
+	w = w.replace(porter_step2)
+	w = w.replace(porter_step3)
+	w = w.step4()
+	w = w.step5()
+	return string(w)
+}
+
+// Check if the letter at i is a consonant, y is a consonant at the start or after a vowel
+func (w porter_word) consonant(i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !w.consonant(i-1)
+	}
+	return true
+}
+
+// Measure of the first n letters
+func (w porter_word) measure(n int) int {
+	m := 0
+	i := 0
+	// Skip the leading consonants
+	for i < n && w.consonant(i) {
+		i++
+	}
+	for i < n {
+		for i < n && !w.consonant(i) {
+			i++
+		}
+		if i >= n {
+			break
+		}
+		for i < n && w.consonant(i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+// Check if the first n letters hold a vowel
+func (w porter_word) hasVowel(n int) bool {
+	for i := range n {
+		if !w.consonant(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the first n letters end with a double consonant
+func (w porter_word) doubleConsonant(n int) bool {
+	return n >= 2 && w[n-1] == w[n-2] && w.consonant(n-1)
+}
+
+// Check if the first n letters end with consonant-vowel-consonant, the last one not w, x or y
+func (w porter_word) cvc(n int) bool {
+	if n < 3 || !w.consonant(n-1) || w.consonant(n-2) || !w.consonant(n-3) {
+		return false
+	}
+	return w[n-1] != 'w' && w[n-1] != 'x' && w[n-1] != 'y'
+}
+
+func (w porter_word) hasSuffix(suffix string) bool {
+	return strings.HasSuffix(string(w), suffix)
+}
+
+// Replace the suffix with replacement, the suffix must be the end of the word
+func (w porter_word) setSuffix(suffix string, replacement string) porter_word {
+	return append(w[:len(w)-len(suffix):len(w)-len(suffix)], replacement...)
+}
+
+// Plurals
+func (w porter_word) step1a() porter_word {
+	switch {
+	case w.hasSuffix("sses"):
+		return w.setSuffix("sses", "ss")
+	case w.hasSuffix("ies"):
+		return w.setSuffix("ies", "i")
+	case w.hasSuffix("ss"):
+		return w
+	case w.hasSuffix("s"):
+		return w.setSuffix("s", "")
+	}
+	return w
+}
+
+// Past participles, -ing forms
+func (w porter_word) step1b() porter_word {
+	if w.hasSuffix("eed") {
+		if w.measure(len(w)-3) > 0 {
+			return w.setSuffix("eed", "ee")
+		}
+		return w
+	}
+
+	var suffix string
+	if w.hasSuffix("ed") && w.hasVowel(len(w)-2) {
+		suffix = "ed"
+	} else if w.hasSuffix("ing") && w.hasVowel(len(w)-3) {
+		suffix = "ing"
+	} else {
+		return w
+	}
+	w = w.setSuffix(suffix, "")
+
+	switch {
+	case w.hasSuffix("at") || w.hasSuffix("bl") || w.hasSuffix("iz"):
+		return append(w, 'e')
+	case w.doubleConsonant(len(w)) && !w.hasSuffix("l") && !w.hasSuffix("s") && !w.hasSuffix("z"):
+		return w[:len(w)-1]
+	case w.measure(len(w)) == 1 && w.cvc(len(w)):
+		return append(w, 'e')
+	}
+	return w
+}
+
+// Terminal y after a vowel
+func (w porter_word) step1c() porter_word {
+	if w.hasSuffix("y") && w.hasVowel(len(w)-1) {
+		return w.setSuffix("y", "i")
+	}
+	return w
+}
+
+// Replace the first matching suffix when the measure of the stem is greater than 0
+func (w porter_word) replace(rules []porter_rule) porter_word {
+	for _, rule := range rules {
+		if !w.hasSuffix(rule.suffix) {
+			continue
+		}
+		if w.measure(len(w)-len(rule.suffix)) > 0 {
+			return w.setSuffix(rule.suffix, rule.replacement)
+		}
+		return w
+	}
+	return w
+}
+
+// Remove the first matching suffix when the measure of the stem is greater than 1
+func (w porter_word) step4() porter_word {
+	for _, suffix := range porter_step4 {
+		if !w.hasSuffix(suffix) {
+			continue
+		}
+		n := len(w) - len(suffix)
+		if suffix == "ion" && (n == 0 || (w[n-1] != 's' && w[n-1] != 't')) {
+			return w
+		}
+		if w.measure(n) > 1 {
+			return w[:n]
+		}
+		return w
+	}
+	return w
+}
+
+// Final e and double l
+func (w porter_word) step5() porter_word {
+	if w.hasSuffix("e") {
+		m := w.measure(len(w) - 1)
+		if m > 1 || (m == 1 && !w.cvc(len(w)-1)) {
+			w = w[:len(w)-1]
+		}
+	}
+	if w.hasSuffix("ll") && w.measure(len(w)) > 1 {
+		w = w[:len(w)-1]
+	}
+	return w
+}
@@ -0,0 +1,92 @@
+package opendivdb
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// Storage backends
+const (
+	Storage_directory = "DIRECTORY" // One file per document under a directory per collection
+	Storage_memory    = "MEMORY"    // Documents are only kept in memory, nothing is written to disk
+	Storage_file      = "FILE"      // Every change is appended to a single file
+	Storage_log       = "LOG"       // Every change is appended to segment files that are compacted in the background
+)
+
+// Storage is where encoded (and encrypted if enabled) documents are kept. Reading, writing
+// and deleting a document that doesn't exist must return an error wrapping fs.ErrNotExist
+// for Read, and no error for Delete. Listing a collection that doesn't exist must return
+// an error wrapping fs.ErrNotExist. Document IDs are listed in ascending order. Subcollections
+// are passed as their path (collection/document/subcollection) and listed by Collections.
+// Drop removes a collection with all of its documents, dropping a collection that doesn't
+// exist must not return an error
+type Storage interface {
+	Read(collection string, id string) ([]byte, error)
+	Write(collection string, id string, b []byte) error
+	Delete(collection string, id string) error
+	Drop(collection string) error
+	List(collection string) ([]string, error)
+	Collections() ([]string, error)
+	Close() error
+}
+
+// Optional interfaces of storage backends, used instead of the slower default when implemented
+type (
+	// Subcollections returns the paths of the subcollections under a collection or document
+	// path at any depth without listing every collection, a path that doesn't exist has none
+	subcollection_storage interface {
+		Subcollections(path string) ([]string, error)
+	}
+
+	// Size returns the size of a stored document without reading it, a document that doesn't
+	// exist returns an error wrapping fs.ErrNotExist
+	size_storage interface {
+		Size(collection string, id string) (int64, error)
+	}
+)
+
+func validateStorage(storage string) error {
+	switch storage {
+	case Storage_directory, Storage_memory, Storage_file, Storage_log:
+		return nil
+	}
+	return fmt.Errorf("storage '%s' is not supported. Accepted values %s, %s, %s, %s", storage, Storage_directory, Storage_memory, Storage_file, Storage_log)
+}
+
+// Open the storage backend selected in the configuration
+func (d *Driver) openStorage(storage string) (Storage, error) {
+	switch storage {
+	case Storage_memory:
+		return newMemoryStorage(), nil
+	case Storage_file:
+		return newFileStorage(d.dir, d.durability, d.read_only)
+	case Storage_log:
+		return newLogStorage(d.dir, d.durability, d.read_only, d.log_segment_size, d.log_compaction)
+	default:
+		return newDirectoryStorage(d.dir, d.durability, d.read_only, d.decodeDocument)
+	}
+}
+
+// Sorted keys of a map of documents
+func sortedIDs[T any](documents map[string]T) []string {
+	ids := make([]string, 0, len(documents))
+	for id := range documents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Classify an error of a storage backend as one of the database's errors, the original error
+// is kept wrapped
+func storageError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%w - %w", ErrNotFound, err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%w - %w", ErrPermission, err)
+	}
+	return err
+}
@@ -0,0 +1,278 @@
+package opendivdb
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffix of the directory next to a document file holding the document's subcollections
+const subcollections_suffix = ".collections"
+
+// Storage keeping each document in its own file under a directory per collection. Documents
+// are written to a temporary file first and then moved into place
+type directory_storage struct {
+	dir        string
+	durability string
+	decode     func(b []byte) (Document, error) // Used to check temporary files during recovery
+}
+
+// Open the directory storage, temporary files left by a crash are recovered unless read-only
+func newDirectoryStorage(dir string, durability string, read_only bool, decode func(b []byte) (Document, error)) (*directory_storage, error) {
+	s := &directory_storage{dir: dir, durability: durability, decode: decode}
+	if !read_only {
+		if err := s.recoverTempFiles(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *directory_storage) Read(collection string, id string) ([]byte, error) {
+	path := filepath.Join(s.collectionDir(collection), id)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("'%s' is not a document", path)
+	}
+	return os.ReadFile(path)
+}
+
+func (s *directory_storage) Size(collection string, id string) (int64, error) {
+	path := filepath.Join(s.collectionDir(collection), id)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, fmt.Errorf("'%s' is not a document", path)
+	}
+	return fi.Size(), nil
+}
+
+func (s *directory_storage) Write(collection string, id string, b []byte) error {
+	dir := s.collectionDir(collection)
+	fnlPath := filepath.Join(dir, id)
+	tmpPath := fnlPath + tmp_suffix
+
+	// create collection directory
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// write document bytes to the disk
+	if err := writeFile(tmpPath, b, s.durability != Durability_none); err != nil {
+		return err
+	}
+
+	// move final file into place
+	if err := os.Rename(tmpPath, fnlPath); err != nil {
+		return err
+	}
+	if s.durability == Durability_full {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+func (s *directory_storage) Delete(collection string, id string) error {
+	path := filepath.Join(s.collectionDir(collection), id)
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode().IsDir() {
+		return fmt.Errorf("deletion of entire collection is not allowed")
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	// The driver deletes the documents of subcollections first, only directories are left
+	if err := os.RemoveAll(path + subcollections_suffix); err != nil {
+		return err
+	}
+	if s.durability == Durability_full {
+		return syncDir(s.collectionDir(collection))
+	}
+	return nil
+}
+
+func (s *directory_storage) Drop(collection string) error {
+	dir := s.collectionDir(collection)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if s.durability == Durability_full {
+		return syncDir(filepath.Dir(dir))
+	}
+	return nil
+}
+
+func (s *directory_storage) List(collection string) ([]string, error) {
+	files, err := os.ReadDir(s.collectionDir(collection))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("'%s' - %w", collection, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		if isDocumentFile(file) {
+			ids = append(ids, file.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (s *directory_storage) Collections() ([]string, error) {
+	return walkCollections(s.dir, "", nil)
+}
+
+// Subcollections walks only the directories under the collection or document
+func (s *directory_storage) Subcollections(path string) ([]string, error) {
+	var (
+		subcollections []string
+		err            error
+	)
+	parts := strings.Split(path, "/")
+	if len(parts)%2 == 0 {
+		// Document path, its subcollections are in the directory next to the document file
+		dir := filepath.Join(s.collectionDir(strings.Join(parts[:len(parts)-1], "/")), parts[len(parts)-1]+subcollections_suffix)
+		subcollections, err = walkCollections(dir, path+"/", nil)
+	} else {
+		subcollections, err = walkDocuments(s.collectionDir(path), path, nil)
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return subcollections, err
+}
+
+// Directory of a collection, the subcollections of a document are kept in a directory next
+// to the document file named after the document ID with subcollections_suffix
+func (s *directory_storage) collectionDir(collection string) string {
+	parts := strings.Split(collection, "/")
+	for i := 1; i < len(parts); i += 2 {
+		parts[i] += subcollections_suffix
+	}
+	return filepath.Join(append([]string{s.dir}, parts...)...)
+}
+
+// Add the collections in dir and the subcollections of their documents to collections, prefix
+// is the path of the document the collections in dir belong to
+func walkCollections(dir string, prefix string, collections []string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return collections, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		collection := prefix + entry.Name()
+		collections = append(collections, collection)
+		collections, err = walkDocuments(filepath.Join(dir, entry.Name()), collection, collections)
+		if err != nil {
+			return collections, err
+		}
+	}
+	return collections, nil
+}
+
+// Add the subcollections of the documents in the directory of collection to collections
+func walkDocuments(dir string, collection string, collections []string) ([]string, error) {
+	documents, err := os.ReadDir(dir)
+	if err != nil {
+		return collections, err
+	}
+	for _, document := range documents {
+		if !document.IsDir() || !strings.HasSuffix(document.Name(), subcollections_suffix) {
+			continue
+		}
+		id := strings.TrimSuffix(document.Name(), subcollections_suffix)
+		collections, err = walkCollections(filepath.Join(dir, document.Name()), collection+"/"+id+"/", collections)
+		if err != nil {
+			return collections, err
+		}
+	}
+	return collections, nil
+}
+
+func (s *directory_storage) Close() error {
+	return nil
+}
+
+// Check if a directory entry of a collection holds a document
+func isDocumentFile(entry os.DirEntry) bool {
+	return entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), tmp_suffix)
+}
+
+// Handle temporary files left behind by writes that were interrupted by a crash. A temporary
+// file holding a complete document newer than the one in place is moved into place, any
+// other temporary file is removed
+func (s *directory_storage) recoverTempFiles() error {
+	collections, err := s.Collections()
+	if err != nil {
+		return nil
+	}
+	for _, collection := range collections {
+		dir := s.collectionDir(collection)
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("unable to read collection '%s' - %w", collection, err)
+		}
+		recovered := false
+		for _, file := range files {
+			if !file.Type().IsRegular() || !strings.HasSuffix(file.Name(), tmp_suffix) {
+				continue
+			}
+			tmp_path := filepath.Join(dir, file.Name())
+			id := strings.TrimSuffix(file.Name(), tmp_suffix)
+			if s.isNewerTempFile(tmp_path, filepath.Join(dir, id), id) {
+				if err := os.Rename(tmp_path, filepath.Join(dir, id)); err != nil {
+					return fmt.Errorf("unable to recover '%s' - %w", tmp_path, err)
+				}
+				recovered = true
+				continue
+			}
+			if err := os.Remove(tmp_path); err != nil {
+				return fmt.Errorf("unable to remove '%s' - %w", tmp_path, err)
+			}
+		}
+		if recovered && s.durability == Durability_full {
+			if err := syncDir(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check if a temporary file holds a complete document that is newer than the one in place
+func (s *directory_storage) isNewerTempFile(tmp_path string, path string, id string) bool {
+	b, err := os.ReadFile(tmp_path)
+	if err != nil {
+		return false
+	}
+	tmp_doc, err := s.decode(b)
+	if err != nil || tmp_doc.ID != id {
+		return false
+	}
+
+	b, err = os.ReadFile(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	doc, err := s.decode(b)
+	if err != nil {
+		return true
+	}
+	return tmp_doc.Updated_at.After(doc.Updated_at)
+}
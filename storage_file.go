@@ -0,0 +1,397 @@
+package opendivdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Name of the file used by the file storage in the database directory
+const file_storage_name = "_data.log"
+
+// Record types of the append-only log
+const (
+	record_write  byte = 'W'
+	record_delete byte = 'D'
+)
+
+// Size of a record header, 4 bytes payload length followed by 4 bytes CRC32 of the payload
+const record_header_size = 8
+
+type (
+	// Storage appending every write and delete as a record to a single file. The location of
+	// the latest version of each document is kept in memory and rebuilt from the file on open
+	file_storage struct {
+		path       string
+		file       *os.File
+		durability string
+		read_only  bool
+		index      map[string]map[string]record_location // Latest version of each document by collection and ID
+		size       int64                                 // Offset of the end of the last complete record
+		mutex      sync.RWMutex
+	}
+
+	record_location struct {
+		offset int64 // Offset of the document bytes
+		size   int   // Length of the document bytes
+	}
+
+	// Record read from a log, the document bytes are not loaded
+	log_record struct {
+		op         byte
+		collection string
+		id         string
+		location   record_location
+	}
+)
+
+// Open the file storage, a record cut short by a crash at the end of the file is removed unless read-only
+func newFileStorage(dir string, durability string, read_only bool) (*file_storage, error) {
+	s := &file_storage{
+		path:       filepath.Join(dir, file_storage_name),
+		durability: durability,
+		read_only:  read_only,
+		index:      make(map[string]map[string]record_location),
+	}
+
+	var err error
+	if read_only {
+		s.file, err = os.Open(s.path)
+	} else {
+		s.file, err = os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file storage - %w", err)
+	}
+
+	if err := s.replay(); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	if !read_only {
+		fi, err := s.file.Stat()
+		if err != nil {
+			s.file.Close()
+			return nil, err
+		}
+		if fi.Size() > s.size {
+			if err := s.file.Truncate(s.size); err != nil {
+				s.file.Close()
+				return nil, fmt.Errorf("unable to remove incomplete record from file storage - %w", err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// Apply records written after s.size to the index, must be called with the mutex held for writing
+func (s *file_storage) replay() error {
+	fi, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	for {
+		record, next, err := readRecord(s.file, s.size, fi.Size())
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		applyRecord(s.index, record)
+		s.size = next
+	}
+}
+
+func (s *file_storage) Read(collection string, id string) ([]byte, error) {
+	// Pick up records written by the process that has the database open for writing
+	if s.read_only {
+		s.mutex.Lock()
+		err := s.replay()
+		s.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	location, ok := s.index[collection][id]
+	if !ok {
+		return nil, fmt.Errorf("'%s/%s' - %w", collection, id, fs.ErrNotExist)
+	}
+	b := make([]byte, location.size)
+	if _, err := s.file.ReadAt(b, location.offset); err != nil {
+		return nil, fmt.Errorf("unable to read '%s/%s' from file storage - %w", collection, id, err)
+	}
+	return b, nil
+}
+
+func (s *file_storage) Size(collection string, id string) (int64, error) {
+	if s.read_only {
+		s.mutex.Lock()
+		err := s.replay()
+		s.mutex.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	location, ok := s.index[collection][id]
+	if !ok {
+		return 0, fmt.Errorf("'%s/%s' - %w", collection, id, fs.ErrNotExist)
+	}
+	return int64(location.size), nil
+}
+
+func (s *file_storage) Write(collection string, id string, b []byte) error {
+	return s.append(record_write, collection, id, b)
+}
+
+func (s *file_storage) Delete(collection string, id string) error {
+	s.mutex.RLock()
+	_, ok := s.index[collection][id]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	return s.append(record_delete, collection, id, nil)
+}
+
+func (s *file_storage) append(op byte, collection string, id string, b []byte) error {
+	if s.read_only {
+		return ErrReadOnly
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := encodeRecord(op, collection, id, b)
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		return err
+	}
+	if s.durability != Durability_none {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+	applyRecord(s.index, log_record{op: op, collection: collection, id: id, location: record_location{offset: s.size + int64(len(record)-len(b)), size: len(b)}})
+	s.size += int64(len(record))
+	return nil
+}
+
+// Append a delete record for every document of the collection
+func (s *file_storage) Drop(collection string) error {
+	s.mutex.RLock()
+	ids := sortedIDs(s.index[collection])
+	s.mutex.RUnlock()
+	for _, id := range ids {
+		if err := s.Delete(collection, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *file_storage) List(collection string) ([]string, error) {
+	if s.read_only {
+		s.mutex.Lock()
+		err := s.replay()
+		s.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	documents, ok := s.index[collection]
+	if !ok {
+		return nil, fmt.Errorf("'%s' - %w", collection, fs.ErrNotExist)
+	}
+	return sortedIDs(documents), nil
+}
+
+func (s *file_storage) Collections() ([]string, error) {
+	if s.read_only {
+		s.mutex.Lock()
+		err := s.replay()
+		s.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return sortedIDs(s.index), nil
+}
+
+func (s *file_storage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// Update an index with a record
+func applyRecord(index map[string]map[string]record_location, record log_record) {
+	switch record.op {
+	case record_write:
+		if _, ok := index[record.collection]; !ok {
+			index[record.collection] = make(map[string]record_location)
+		}
+		index[record.collection][record.id] = record.location
+	case record_delete:
+		delete(index[record.collection], record.id)
+		if len(index[record.collection]) == 0 {
+			delete(index, record.collection)
+		}
+	}
+}
+
+// Build a record. The payload is the record type, the collection and ID each prefixed with
+// their 2 byte length, followed by the document bytes
+func encodeRecord(op byte, collection string, id string, b []byte) []byte {
+	payload_size := 1 + 2 + len(collection) + 2 + len(id) + len(b)
+	record := make([]byte, record_header_size+payload_size)
+	payload := record[record_header_size:]
+
+	payload[0] = op
+	binary.BigEndian.PutUint16(payload[1:], uint16(len(collection)))
+	n := 3 + copy(payload[3:], collection)
+	binary.BigEndian.PutUint16(payload[n:], uint16(len(id)))
+	n += 2 + copy(payload[n+2:], id)
+	copy(payload[n:], b)
+
+	binary.BigEndian.PutUint32(record[0:], uint32(payload_size))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	return record
+}
+
+// Read the record at offset of a log end bytes long, returns the record and the offset of
+// the next one. io.EOF is returned when there is no complete record at offset and it is the
+// tail of the log cut short by a crash, a record that isn't valid with more records after it
+// returns an error
+func readRecord(r io.ReaderAt, offset int64, end int64) (log_record, int64, error) {
+	header := make([]byte, record_header_size)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return log_record{}, offset, io.EOF
+		}
+		return log_record{}, offset, err
+	}
+	payload_size := binary.BigEndian.Uint32(header[0:])
+	if offset+record_header_size+int64(payload_size) > end {
+		return log_record{}, offset, tornRecord(r, offset, end)
+	}
+	payload := make([]byte, payload_size)
+	if _, err := r.ReadAt(payload, offset+record_header_size); err != nil {
+		if errors.Is(err, io.EOF) {
+			return log_record{}, offset, io.EOF
+		}
+		return log_record{}, offset, err
+	}
+	next := offset + record_header_size + int64(payload_size)
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) || payload_size < 5 {
+		return log_record{}, offset, invalidRecord(r, offset, next, end)
+	}
+
+	record := log_record{op: payload[0]}
+	collection_size := int(binary.BigEndian.Uint16(payload[1:]))
+	if 3+collection_size+2 > len(payload) {
+		return log_record{}, offset, invalidRecord(r, offset, next, end)
+	}
+	record.collection = string(payload[3 : 3+collection_size])
+	n := 3 + collection_size
+	id_size := int(binary.BigEndian.Uint16(payload[n:]))
+	n += 2
+	if n+id_size > len(payload) {
+		return log_record{}, offset, invalidRecord(r, offset, next, end)
+	}
+	record.id = string(payload[n : n+id_size])
+	n += id_size
+	record.location = record_location{offset: offset + record_header_size + int64(n), size: len(payload) - n}
+
+	return record, next, nil
+}
+
+// Error of a record at offset that isn't valid. A record that was only partially written by a
+// crash is the last one of the log, or is followed by the zero bytes the file was extended
+// with, it returns io.EOF so the tail is ignored. Anything else is corruption, the records
+// after it must not be discarded
+func invalidRecord(r io.ReaderAt, offset int64, next int64, end int64) error {
+	if next >= end {
+		return io.EOF
+	}
+	buffer := make([]byte, 64<<10)
+	for position := next; position < end; {
+		n, err := r.ReadAt(buffer[:min(int64(len(buffer)), end-position)], position)
+		for _, b := range buffer[:n] {
+			if b != 0 {
+				return fmt.Errorf("corrupt record at offset %d with records after it", offset)
+			}
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		position += int64(n)
+	}
+	return io.EOF
+}
+
+// Error of a record at offset whose length runs past the end of the log. A record cut short by
+// a crash is the last one of the log, it returns io.EOF so the tail is ignored. A valid record
+// after it means the length itself is corrupt, the records after it must not be discarded
+func tornRecord(r io.ReaderAt, offset int64, end int64) error {
+	buffer := make([]byte, 64<<10)
+	for position := offset + 1; position+record_header_size <= end; {
+		n, err := r.ReadAt(buffer[:min(int64(len(buffer)), end-position)], position)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if n < record_header_size {
+			break
+		}
+		for i := 0; i+record_header_size <= n; i++ {
+			valid, err := validRecord(r, position+int64(i), buffer[i:i+record_header_size], end)
+			if err != nil {
+				return err
+			}
+			if valid {
+				return fmt.Errorf("corrupt record at offset %d with records after it", offset)
+			}
+		}
+		// Overlap the chunks so headers across the boundary are checked
+		position += int64(n - record_header_size + 1)
+	}
+	return io.EOF
+}
+
+// Check if header at offset starts a complete record with a matching CRC
+func validRecord(r io.ReaderAt, offset int64, header []byte, end int64) (bool, error) {
+	payload_size := binary.BigEndian.Uint32(header[0:])
+	if payload_size < 5 || offset+record_header_size+int64(payload_size) > end {
+		return false, nil
+	}
+	payload := make([]byte, payload_size)
+	if _, err := r.ReadAt(payload, offset+record_header_size); err != nil {
+		return false, err
+	}
+	switch payload[0] {
+	case record_write, record_delete, record_merge:
+		return crc32.ChecksumIEEE(payload) == binary.BigEndian.Uint32(header[4:]), nil
+	}
+	return false, nil
+}
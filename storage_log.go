@@ -0,0 +1,595 @@
+package opendivdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory of the log storage's segments in the database directory
+const log_storage_dir = "_log"
+
+// Record written at the start of a segment produced by compaction, its ID holds the lowest
+// segment ID the compaction replaced
+const record_merge byte = 'M'
+
+type (
+	// Storage appending every write and delete to segment files. A new segment is started when
+	// the active one reaches the segment size, and segments no longer written to are merged in
+	// the background to drop replaced and deleted documents. The location of the latest
+	// version of each document is kept in memory and rebuilt from the segments on open
+	log_storage struct {
+		dir                string
+		durability         string
+		read_only          bool
+		segment_size       int64                              // Size at which a new segment is started
+		compaction_ratio   float64                            // Share of replaced or deleted bytes that triggers a compaction
+		segments           map[int]*log_segment               // Open segments by ID
+		active             *log_segment                       // Segment appended to
+		keydir             map[string]map[string]log_location // Latest version of each document by collection and ID
+		mutex              sync.RWMutex
+		compaction_mutex   sync.Mutex // Only one compaction runs at a time
+		done               chan struct{}
+		stop_once          sync.Once
+		compaction_running sync.WaitGroup
+	}
+
+	log_segment struct {
+		id    int
+		file  *os.File
+		size  int64 // Offset of the end of the last complete record
+		live  int64 // Bytes of records holding the latest version of a document
+		merge int   // Lowest segment ID replaced by this segment if it was produced by compaction, 0 otherwise
+	}
+
+	log_location struct {
+		segment     int
+		location    record_location
+		record_size int64
+	}
+)
+
+// Open the log storage and start background compaction unless read-only
+func newLogStorage(dir string, durability string, read_only bool, segment_size int64, compaction_interval time.Duration) (*log_storage, error) {
+	s := &log_storage{
+		dir:              filepath.Join(dir, log_storage_dir),
+		durability:       durability,
+		read_only:        read_only,
+		segment_size:     segment_size,
+		compaction_ratio: 0.5,
+		done:             make(chan struct{}),
+	}
+	if !read_only {
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.load(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	if !read_only {
+		s.compaction_running.Add(1)
+		go s.runCompaction(compaction_interval)
+	}
+	return s, nil
+}
+
+func segmentName(id int) string {
+	return fmt.Sprintf("%08d.seg", id)
+}
+
+// Open every segment and rebuild the key directory, must be called with the mutex held for
+// writing or before the storage is shared
+func (s *log_storage) load() error {
+	s.segments = make(map[int]*log_segment)
+	s.keydir = make(map[string]map[string]log_location)
+	s.active = nil
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil && !(s.read_only && os.IsNotExist(err)) {
+		return fmt.Errorf("unable to read log storage - %w", err)
+	}
+	var ids []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasSuffix(name, ".seg") {
+			// Output of a compaction interrupted by a crash
+			if strings.HasSuffix(name, tmp_suffix) && !s.read_only {
+				os.Remove(filepath.Join(s.dir, name))
+			}
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".seg"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if err := s.openSegment(id); err != nil {
+			return err
+		}
+	}
+
+	// Segments replaced by a compaction that was interrupted before they were removed
+	for _, id := range ids {
+		segment, ok := s.segments[id]
+		if !ok || segment.merge == 0 {
+			continue
+		}
+		for _, old := range ids {
+			if old >= segment.merge && old < id {
+				if err := s.dropSegment(old); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Replay the remaining segments oldest first
+	ids = ids[:0]
+	for id := range s.segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for i, id := range ids {
+		segment := s.segments[id]
+		if err := s.replay(segment); err != nil {
+			return err
+		}
+		if i == len(ids)-1 {
+			s.active = segment
+		}
+	}
+
+	if s.active == nil && !s.read_only {
+		return s.roll()
+	}
+	if !s.read_only {
+		// Remove a record cut short by a crash at the end of the active segment
+		fi, err := s.active.file.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() > s.active.size {
+			if err := s.active.file.Truncate(s.active.size); err != nil {
+				return fmt.Errorf("unable to remove incomplete record from log storage - %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Open a segment and read its merge record
+func (s *log_storage) openSegment(id int) error {
+	path := filepath.Join(s.dir, segmentName(id))
+	var (
+		file *os.File
+		err  error
+	)
+	if s.read_only {
+		file, err = os.Open(path)
+	} else {
+		file, err = os.OpenFile(path, os.O_RDWR, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open segment '%s' - %w", path, err)
+	}
+	segment := &log_segment{id: id, file: file}
+	s.segments[id] = segment
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	record, _, err := readRecord(file, 0, fi.Size())
+	if err == nil && record.op == record_merge {
+		segment.merge, _ = strconv.Atoi(record.id)
+	}
+	return nil
+}
+
+// Close and remove a segment
+func (s *log_storage) dropSegment(id int) error {
+	segment, ok := s.segments[id]
+	if !ok {
+		return nil
+	}
+	segment.file.Close()
+	delete(s.segments, id)
+	if s.read_only {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(s.dir, segmentName(id))); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove segment %d - %w", id, err)
+	}
+	return nil
+}
+
+// Apply the records of a segment written after segment.size to the key directory
+func (s *log_storage) replay(segment *log_segment) error {
+	fi, err := segment.file.Stat()
+	if err != nil {
+		return err
+	}
+	for {
+		record, next, err := readRecord(segment.file, segment.size, fi.Size())
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		s.apply(segment, record, next-segment.size)
+		segment.size = next
+	}
+}
+
+// Update the key directory and live bytes with a record, must be called with the mutex held for writing
+func (s *log_storage) apply(segment *log_segment, record log_record, record_size int64) {
+	if record.op != record_write && record.op != record_delete {
+		return
+	}
+	// The previous version of the document is no longer live
+	if previous, ok := s.keydir[record.collection][record.id]; ok {
+		if old, ok := s.segments[previous.segment]; ok {
+			old.live -= previous.record_size
+		}
+	}
+
+	switch record.op {
+	case record_write:
+		if _, ok := s.keydir[record.collection]; !ok {
+			s.keydir[record.collection] = make(map[string]log_location)
+		}
+		s.keydir[record.collection][record.id] = log_location{segment: segment.id, location: record.location, record_size: record_size}
+		segment.live += record_size
+	case record_delete:
+		delete(s.keydir[record.collection], record.id)
+		if len(s.keydir[record.collection]) == 0 {
+			delete(s.keydir, record.collection)
+		}
+	}
+}
+
+// Start a new active segment, must be called with the mutex held for writing
+func (s *log_storage) roll() error {
+	id := 1
+	if s.active != nil {
+		id = s.active.id + 1
+	}
+	path := filepath.Join(s.dir, segmentName(id))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create segment '%s' - %w", path, err)
+	}
+	if s.durability == Durability_full {
+		if err := syncDir(s.dir); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	s.active = &log_segment{id: id, file: file}
+	s.segments[id] = s.active
+	return nil
+}
+
+// Pick up segments written by the process that has the database open for writing
+func (s *log_storage) refresh() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	segments := 0
+	changed := false
+	for _, entry := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".seg"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".seg") {
+			continue
+		}
+		segments++
+		if _, ok := s.segments[id]; !ok {
+			changed = true
+		}
+	}
+	// Segments were added or compacted, rebuild everything
+	if changed || segments != len(s.segments) {
+		s.closeSegments()
+		return s.load()
+	}
+	if s.active != nil {
+		return s.replay(s.active)
+	}
+	return nil
+}
+
+func (s *log_storage) Read(collection string, id string) ([]byte, error) {
+	if s.read_only {
+		if err := s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	location, ok := s.keydir[collection][id]
+	if !ok {
+		return nil, fmt.Errorf("'%s/%s' - %w", collection, id, fs.ErrNotExist)
+	}
+	b := make([]byte, location.location.size)
+	if _, err := s.segments[location.segment].file.ReadAt(b, location.location.offset); err != nil {
+		return nil, fmt.Errorf("unable to read '%s/%s' from log storage - %w", collection, id, err)
+	}
+	return b, nil
+}
+
+func (s *log_storage) Size(collection string, id string) (int64, error) {
+	if s.read_only {
+		if err := s.refresh(); err != nil {
+			return 0, err
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	location, ok := s.keydir[collection][id]
+	if !ok {
+		return 0, fmt.Errorf("'%s/%s' - %w", collection, id, fs.ErrNotExist)
+	}
+	return int64(location.location.size), nil
+}
+
+func (s *log_storage) Write(collection string, id string, b []byte) error {
+	return s.append(record_write, collection, id, b)
+}
+
+func (s *log_storage) Delete(collection string, id string) error {
+	s.mutex.RLock()
+	_, ok := s.keydir[collection][id]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	return s.append(record_delete, collection, id, nil)
+}
+
+func (s *log_storage) append(op byte, collection string, id string, b []byte) error {
+	if s.read_only {
+		return ErrReadOnly
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.active.size >= s.segment_size {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	record := encodeRecord(op, collection, id, b)
+	if _, err := s.active.file.WriteAt(record, s.active.size); err != nil {
+		return err
+	}
+	if s.durability != Durability_none {
+		if err := s.active.file.Sync(); err != nil {
+			return err
+		}
+	}
+	location := record_location{offset: s.active.size + int64(len(record)-len(b)), size: len(b)}
+	s.apply(s.active, log_record{op: op, collection: collection, id: id, location: location}, int64(len(record)))
+	s.active.size += int64(len(record))
+	return nil
+}
+
+// Append a delete record for every document of the collection
+func (s *log_storage) Drop(collection string) error {
+	s.mutex.RLock()
+	ids := sortedIDs(s.keydir[collection])
+	s.mutex.RUnlock()
+	for _, id := range ids {
+		if err := s.Delete(collection, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *log_storage) List(collection string) ([]string, error) {
+	if s.read_only {
+		if err := s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	documents, ok := s.keydir[collection]
+	if !ok {
+		return nil, fmt.Errorf("'%s' - %w", collection, fs.ErrNotExist)
+	}
+	return sortedIDs(documents), nil
+}
+
+func (s *log_storage) Collections() ([]string, error) {
+	if s.read_only {
+		if err := s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return sortedIDs(s.keydir), nil
+}
+
+// Stop background compaction and close every segment
+func (s *log_storage) Close() error {
+	s.stop_once.Do(func() { close(s.done) })
+	s.compaction_running.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closeSegments()
+}
+
+// Must be called with the mutex held for writing
+func (s *log_storage) closeSegments() error {
+	var err error
+	for id, segment := range s.segments {
+		if close_err := segment.file.Close(); close_err != nil && err == nil {
+			err = close_err
+		}
+		delete(s.segments, id)
+	}
+	return err
+}
+
+// Must be run as a go routine. Checks if segments need compacting every interval until the storage is closed
+func (s *log_storage) runCompaction(interval time.Duration) {
+	defer s.compaction_running.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.compact(false); err != nil {
+				fmt.Println("[ERROR] log storage compaction failed " + err.Error())
+			}
+		}
+	}
+}
+
+// Merge every segment before the active one into a single segment holding only the latest
+// version of each document. Unless force is set segments are only merged when the share of
+// replaced or deleted bytes reaches the compaction ratio
+func (s *log_storage) compact(force bool) error {
+	s.compaction_mutex.Lock()
+	defer s.compaction_mutex.Unlock()
+
+	// Take the segments to merge and the documents they hold
+	s.mutex.RLock()
+	var (
+		ids         []int
+		total, live int64
+	)
+	for id, segment := range s.segments {
+		if id != s.active.id {
+			ids = append(ids, id)
+			total += segment.size
+			live += segment.live
+		}
+	}
+	sort.Ints(ids)
+	if len(ids) == 0 || (!force && (total == 0 || float64(total-live)/float64(total) < s.compaction_ratio)) {
+		s.mutex.RUnlock()
+		return nil
+	}
+	merged := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		merged[id] = true
+	}
+	type copy_entry struct {
+		collection, id string
+		from           log_location
+	}
+	var entries []copy_entry
+	for collection, documents := range s.keydir {
+		for id, location := range documents {
+			if merged[location.segment] {
+				entries = append(entries, copy_entry{collection: collection, id: id, from: location})
+			}
+		}
+	}
+	s.mutex.RUnlock()
+
+	// Write the merged segment to a temporary file, the segments being merged are no longer
+	// written to so they can be read without holding the mutex
+	low, high := ids[0], ids[len(ids)-1]
+	tmp_path := filepath.Join(s.dir, segmentName(high)+tmp_suffix)
+	out, err := os.OpenFile(tmp_path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	cleanup := func(err error) error {
+		out.Close()
+		os.Remove(tmp_path)
+		return err
+	}
+	merge_record := encodeRecord(record_merge, "", strconv.Itoa(low), nil)
+	if _, err := out.Write(merge_record); err != nil {
+		return cleanup(err)
+	}
+	offset := int64(len(merge_record))
+	moved := make([]log_location, len(entries))
+	for i, entry := range entries {
+		s.mutex.RLock()
+		segment := s.segments[entry.from.segment]
+		b := make([]byte, entry.from.location.size)
+		_, err := segment.file.ReadAt(b, entry.from.location.offset)
+		s.mutex.RUnlock()
+		if err != nil {
+			return cleanup(err)
+		}
+		record := encodeRecord(record_write, entry.collection, entry.id, b)
+		if _, err := out.Write(record); err != nil {
+			return cleanup(err)
+		}
+		moved[i] = log_location{segment: high, location: record_location{offset: offset + int64(len(record)-len(b)), size: len(b)}, record_size: int64(len(record))}
+		offset += int64(len(record))
+	}
+	if err := out.Sync(); err != nil {
+		return cleanup(err)
+	}
+
+	// Swap the merged segment in, documents written since the merge started keep their new location
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	segment := &log_segment{id: high, size: offset, merge: low}
+	for i, entry := range entries {
+		if current, ok := s.keydir[entry.collection][entry.id]; ok && current == entry.from {
+			s.keydir[entry.collection][entry.id] = moved[i]
+			segment.live += moved[i].record_size
+		}
+	}
+	if err := s.segments[high].file.Close(); err != nil {
+		return cleanup(err)
+	}
+	delete(s.segments, high)
+	if err := os.Rename(tmp_path, filepath.Join(s.dir, segmentName(high))); err != nil {
+		return cleanup(err)
+	}
+	segment.file = out
+	s.segments[high] = segment
+	if s.durability == Durability_full {
+		if err := syncDir(s.dir); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids[:len(ids)-1] {
+		if err := s.dropSegment(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
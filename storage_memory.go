@@ -0,0 +1,90 @@
+package opendivdb
+
+import (
+	"fmt"
+	"io/fs"
+	"sync"
+)
+
+// Storage keeping documents in memory only, everything is lost when the driver is closed
+type memory_storage struct {
+	collections map[string]map[string][]byte
+	mutex       sync.RWMutex
+}
+
+func newMemoryStorage() *memory_storage {
+	return &memory_storage{collections: make(map[string]map[string][]byte)}
+}
+
+func (s *memory_storage) Read(collection string, id string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, ok := s.collections[collection][id]
+	if !ok {
+		return nil, fmt.Errorf("'%s/%s' - %w", collection, id, fs.ErrNotExist)
+	}
+	return b, nil
+}
+
+func (s *memory_storage) Size(collection string, id string) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, ok := s.collections[collection][id]
+	if !ok {
+		return 0, fmt.Errorf("'%s/%s' - %w", collection, id, fs.ErrNotExist)
+	}
+	return int64(len(b)), nil
+}
+
+func (s *memory_storage) Write(collection string, id string, b []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.collections[collection]; !ok {
+		s.collections[collection] = make(map[string][]byte)
+	}
+	// Keep a copy so the caller can't change the stored document
+	s.collections[collection][id] = append([]byte(nil), b...)
+	return nil
+}
+
+func (s *memory_storage) Delete(collection string, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.collections[collection], id)
+	if len(s.collections[collection]) == 0 {
+		delete(s.collections, collection)
+	}
+	return nil
+}
+
+func (s *memory_storage) Drop(collection string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.collections, collection)
+	return nil
+}
+
+func (s *memory_storage) List(collection string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	documents, ok := s.collections[collection]
+	if !ok {
+		return nil, fmt.Errorf("'%s' - %w", collection, fs.ErrNotExist)
+	}
+	return sortedIDs(documents), nil
+}
+
+func (s *memory_storage) Collections() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return sortedIDs(s.collections), nil
+}
+
+func (s *memory_storage) Close() error {
+	return nil
+}
@@ -1,11 +1,20 @@
 package opendivdb
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	"github.com/google/uuid"
 )
 
+// Policies applied when a subscriber's buffer is full and a new snapshot is ready
+const (
+	Subscription_coalesce    = "COALESCE"    // Drop every pending snapshot and keep only the latest one
+	Subscription_drop_oldest = "DROP_OLDEST" // Drop the oldest pending snapshot to make room for the latest one
+	Subscription_disconnect  = "DISCONNECT"  // Close the subscription with an error
+)
+
 // Subscription struct, either Collection or Filter needs to be specified
 type (
 	Subscription struct {
@@ -13,7 +22,17 @@ type (
 		id           string
 		collection   *Collection
 		channel      chan Snapshot
+		notify       chan struct{} // Signals the push loop that a new snapshot is needed
+		done         chan struct{} // Closed when the subscription is closed to stop the push loop
+		policy       string
+		mutex        sync.Mutex
 		unsubscribed bool
+		err          error // Reason the subscription was closed by the database, nil if closed by Unsubscribe
+	}
+
+	SubscriptionOptions struct {
+		Buffer int    // Number of snapshots that can be queued for the subscriber
+		Policy string // What to do when the buffer is full, COALESCE, DROP_OLDEST or DISCONNECT
 	}
 
 	Snapshot struct {
@@ -22,35 +41,90 @@ type (
 	}
 )
 
-// // Create new subscription for the entire collection
+// Create new subscription for the entire collection using the driver's default buffering options
 func (c *Collection) Subscribe() (*Subscription, error) {
-	channel := make(chan Snapshot)
+	return c.SubscribeWithOptions(SubscriptionOptions{})
+}
+
+// Create new subscription with custom buffering options, zero values fall back to the driver's defaults
+func (c *Collection) SubscribeWithOptions(options SubscriptionOptions) (*Subscription, error) {
+	return c.SubscribeContext(context.Background(), options)
+}
+
+// Same as SubscribeWithOptions, the subscription is closed with ctx's error once ctx is done
+func (c *Collection) SubscribeContext(ctx context.Context, options SubscriptionOptions) (*Subscription, error) {
+	if options.Buffer == 0 {
+		options.Buffer = c.driver.sub_buffer
+	}
+	if options.Policy == "" {
+		options.Policy = c.driver.sub_policy
+	}
+	if options.Buffer < 0 {
+		return nil, fmt.Errorf("subscription buffer can't be negative")
+	}
+	if err := validateSubscriptionPolicy(options.Policy); err != nil {
+		return nil, err
+	}
+
+	if err := c.driver.begin(); err != nil {
+		return nil, err
+	}
+	defer c.driver.end()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Copy the collection so later changes to the caller's filter don't affect the subscription
+	collection := *c
 
 	sub := Subscription{
-		driver:       c.driver,
-		id:           uuid.NewString(),
-		collection:   c,
-		channel:      channel,
-		unsubscribed: false,
+		driver:     c.driver,
+		id:         uuid.NewString(),
+		collection: &collection,
+		channel:    make(chan Snapshot, options.Buffer),
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		policy:     options.Policy,
 	}
 
 	c.driver.mutex.Lock()
-	defer c.driver.mutex.Unlock()
-
 	c.driver.subs[sub.id] = &sub
-	go sub.push()
+	c.driver.mutex.Unlock()
+
+	go sub.run()
+	if ctx.Done() != nil {
+		go sub.closeOnDone(ctx)
+	}
+	sub.trigger()
 	return &sub, nil
 }
 
+func validateSubscriptionPolicy(policy string) error {
+	switch policy {
+	case Subscription_coalesce, Subscription_drop_oldest, Subscription_disconnect:
+		return nil
+	}
+	return fmt.Errorf("subscription policy '%s' is not supported. Accepted policies %s, %s, %s", policy, Subscription_coalesce, Subscription_drop_oldest, Subscription_disconnect)
+}
+
 func (d *Driver) checkSubscriptionPush(collection_name string, doc Document) {
-	// Loop through each subscription
+	// Copy subscriptions so the driver mutex isn't held while filters are checked
+	d.mutex.Lock()
+	subs := make([]*Subscription, 0, len(d.subs))
 	for _, sub := range d.subs {
+		subs = append(subs, sub)
+	}
+	d.mutex.Unlock()
+
+	// Loop through each subscription
+	for _, sub := range subs {
 		// If the subscription's collection name doesn't matches the document's collection name carry on
 		if sub.collection.collection_name != collection_name {
 			continue
 		}
 		// If the subscription has a filter, need to check if this document is included
-		if sub.collection.filter.field != "" {
+		if sub.collection.filter.isSet() {
 			// Check if doc is included in the filter
 			include, err := sub.collection.filter.included(doc)
 			if err != nil {
@@ -60,43 +134,140 @@ func (d *Driver) checkSubscriptionPush(collection_name string, doc Document) {
 				continue
 			}
 		}
-		go sub.push()
+		sub.trigger()
 	}
 }
 
-func (s *Subscription) push() {
-	if s.unsubscribed {
-		return
+// Request a new snapshot. Requests made while one is already pending are merged into it
+func (s *Subscription) trigger() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
 	}
+}
+
+// Push loop, one per subscription so snapshots are built and delivered in order
+func (s *Subscription) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.notify:
+			s.push()
+		}
+	}
+}
+
+func (s *Subscription) push() {
 	snapshot := Snapshot{}
 	col, err := s.collection.Documents()
 	if err != nil {
-		snapshot.Error = fmt.Errorf("unable to retrieve documents " + err.Error())
+		snapshot.Error = fmt.Errorf("unable to retrieve documents - %w", err)
 	}
 	snapshot.Data = col
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.unsubscribed {
+		return
+	}
+
+	select {
+	case s.channel <- snapshot:
+		return
+	default:
+	}
+
+	// Buffer is full, apply the subscription's slow consumer policy
+	switch s.policy {
+	case Subscription_coalesce:
+		s.drain()
+	case Subscription_drop_oldest:
+		// The subscriber may have taken the oldest snapshot in the meantime
+		select {
+		case <-s.channel:
+		default:
+		}
+	case Subscription_disconnect:
+		s.close(fmt.Errorf("subscription has been disconnected, consumer is too slow"))
+		return
+	}
 	s.channel <- snapshot
 }
 
-func (s *Subscription) Unsubscribe() {
+// Close the subscription, must be called with the subscription mutex held
+func (s *Subscription) close(reason error) {
+	if s.unsubscribed {
+		return
+	}
 	s.unsubscribed = true
+	s.err = reason
+	close(s.done)
+	// Discard pending snapshots so the subscriber sees the close straight away
+	s.drain()
 	close(s.channel)
+
 	s.driver.mutex.Lock()
 	defer s.driver.mutex.Unlock()
 	delete(s.driver.subs, s.id)
 }
 
-func (s *Subscription) Next() Snapshot {
+// Discard pending snapshots, must be called with the subscription mutex held. Next receives
+// without the mutex so the receives can't block
+func (s *Subscription) drain() {
 	for {
 		select {
-		case snap, ok := <-s.channel:
-			if !ok {
-				return Snapshot{Error: fmt.Errorf("subscription has been closed")}
-			}
-			return snap
+		case <-s.channel:
 		default:
-			if s.unsubscribed {
-				return Snapshot{Error: fmt.Errorf("subscription has been closed")}
-			}
+			return
+		}
+	}
+}
+
+// Close the subscriptions of a collection, or every subscription if collection_name is empty
+func (d *Driver) closeSubscriptions(collection_name string, reason error) {
+	d.mutex.Lock()
+	subs := make([]*Subscription, 0, len(d.subs))
+	for _, sub := range d.subs {
+		if collection_name == "" || sub.collection.collection_name == collection_name {
+			subs = append(subs, sub)
+		}
+	}
+	d.mutex.Unlock()
+	for _, sub := range subs {
+		sub.mutex.Lock()
+		sub.close(reason)
+		sub.mutex.Unlock()
+	}
+}
+
+// Close the subscription once ctx is done, returns when the subscription is closed
+func (s *Subscription) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.close(ctx.Err())
+	case <-s.done:
+	}
+}
+
+func (s *Subscription) Unsubscribe() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.close(nil)
+}
+
+// Next blocks until the next snapshot is available
+func (s *Subscription) Next() Snapshot {
+	snap, ok := <-s.channel
+	if !ok {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.err != nil {
+			return Snapshot{Error: s.err}
 		}
+		return Snapshot{Error: fmt.Errorf("subscription has been closed")}
 	}
+	return snap
 }